@@ -1,51 +1,130 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"celebration/frames"
 	"celebration/ledcontrol"
+	"celebration/prefs"
 
 	"github.com/gorilla/websocket"
 )
 
+// version is stamped at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0" .
+var version = "dev"
+
+// Everything the client says to the server goes through these two, so a
+// test (or a proxy setup) can swap in its own: fetchPrefs uses httpClient,
+// connectToWebSocket dials the active server with dialer on every attempt.
+var (
+	httpClient = &http.Client{Timeout: 15 * time.Second}
+	dialer     = &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		EnableCompression: wsCompression,
+		Subprotocols:      []string{wsSubprotocol},
+	}
+)
+
+// Where Server.go is running. API_BASE / WS_URL (env) or "apiBase" /
+// "wsUrl" (config.json) override these; see configureEndpoints.
 var (
-	// Change these to wherever Server.go is running
 	apiBase = "https://webhook-listener-2i7r.onrender.com"
 	wsURL   = "wss://webhook-listener-2i7r.onrender.com/ws"
 )
 
+// servers is the primary endpoint followed by config.json's "servers"
+// fallbacks. The reconnect loop moves to the next one after failoverAfter
+// failed dials in a row; prefs are fetched from whichever is active.
+var (
+	servers   []endpoint
+	serverIdx atomic.Int32
+)
+
+const failoverAfter = 3
+
+type endpoint struct{ api, ws string }
+
+// activeServer is the endpoint currently in use.
+func activeServer() endpoint {
+	if len(servers) == 0 {
+		return endpoint{apiBase, wsURL}
+	}
+	return servers[int(serverIdx.Load())%len(servers)]
+}
+
+// nextServer rotates to the following endpoint, if there is more than one.
+func nextServer() {
+	if len(servers) < 2 {
+		return
+	}
+	s := servers[int(serverIdx.Add(1))%len(servers)]
+	log.Printf("Switching to server %s (ws %s)", s.api, s.ws)
+}
+
 // ---------- types ----------
 type WSMessage struct {
-	Type     string `json:"type"`
-	Effect   string `json:"effect"`
-	ColorHex string `json:"color"`
-	Cycles   int    `json:"cycles"`
+	Type       string   `json:"type"`
+	Effect     string   `json:"effect"`
+	ColorHex   string   `json:"color"`
+	Cycles     int      `json:"cycles"`
+	Brightness *int     `json:"brightness,omitempty"`
+	Palette    string   `json:"palette,omitempty"`
+	Text       string   `json:"text,omitempty"` // scroll_text banner
+	FadeCurve  string   `json:"fadeCurve,omitempty"`
+	HeadGlow   float64  `json:"headGlow,omitempty"`   // comet head overshoot, 0..1
+	Mirror     bool     `json:"mirror,omitempty"`     // reflect the effect about the middle
+	Intensity  *float64 `json:"intensity,omitempty"`  // 0..1: how big a show (deal size); nil = full
+	StartAt    int64    `json:"startAt,omitempty"`    // unix millis to start at (synchronized waves)
+	DurationMs int      `json:"durationMs,omitempty"` // "countdown": how long it runs; "nudge": dwell
 }
 
-type EffectPref struct {
-	Effect string `json:"effect"`
-	Color  string `json:"color"`
-	Cycles int    `json:"cycles"`
-}
-type IdlePref struct {
-	Effect string `json:"effect"`
-	Color  string `json:"color"`
-	Cycles int    `json:"cycles"`
+// Envelope wraps every websocket message: {"v":1,"type":"...","payload":{...}}.
+// Messages without "v" are the older bare format and go through legacyMessage.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
-type DevicePrefs struct {
-	Idle   IdlePref              `json:"idle"`
-	Events map[string]EffectPref `json:"events"`
+
+const protoVersion = 1
+
+// wsSubprotocol is offered on connect; the server refuses sockets without it.
+var wsSubprotocol = fmt.Sprintf("celebration.v%d", protoVersion)
+
+// Hello is sent once right after the websocket opens so the server knows
+// what this strip can do.
+type Hello struct {
+	Type     string   `json:"type,omitempty"`
+	Version  string   `json:"version"`
+	Effects  []string `json:"effects"`
+	LedCount int      `json:"ledCount"`
 }
 type ClientIdent struct {
 	DeviceID     string `json:"deviceId"`
@@ -53,16 +132,39 @@ type ClientIdent struct {
 }
 
 type effectJob struct {
-	effect string
-	color  uint32
-	cycles int
+	event      string // event type that produced it, for coalescing
+	effect     string
+	color      uint32
+	cycles     int
+	brightness *int
+	palette    []uint32
+	text       string
+	hold       bool // don't resume idle afterwards
+	curve      frames.Curve
+	headGlow   float64
+	mirror     bool
+	value      int           // "count" only
+	duration   time.Duration // "countdown" and "nudge" only
+	intensity  float64       // 0..1, 1 = the effect's full show
+	startAt    time.Time     // zero = as soon as it's popped
 }
 
+// devicePrefs is replaced by the read loop and read by the worker, the
+// frame timer and the idle code; prefsMu guards it. Readers take a copy
+// with currentPrefs. The Events map is never modified in place, only
+// replaced, so a copy may share it.
 var (
-	devicePrefs = DevicePrefs{Events: map[string]EffectPref{}}
-	jobs        = make(chan effectJob, 32) // serialize effects
+	prefsMu     sync.RWMutex
+	devicePrefs = prefs.Prefs{Events: map[string]prefs.Event{}}
+	jobs        = newEffectQueue(32, queueDropOldest) // serialize effects
 )
 
+func currentPrefs() prefs.Prefs {
+	prefsMu.RLock()
+	defer prefsMu.RUnlock()
+	return devicePrefs
+}
+
 // ---------- identity & signing ----------
 func loadIdent() (ClientIdent, error) {
 	var id ClientIdent
@@ -100,104 +202,699 @@ func parseHexColor(s string) uint32 {
 }
 func must[T any](v T, _ error) T { return v }
 
+// ---------- websocket keepalive ----------
+// WS_READ_TIMEOUT / WS_PING_INTERVAL ("60s", "2m" or plain seconds) tune
+// the keepalive for slow links; the timeout should cover ~2 pings.
+var wsReadTimeout, wsPingInterval = keepaliveFromEnv(60*time.Second, 30*time.Second)
+
+// wsCompression offers permessage-deflate (mostly for raw frames);
+// WS_COMPRESSION=0 turns it off for proxies that mishandle it.
+var wsCompression = os.Getenv("WS_COMPRESSION") != "0"
+
+// cancelOnDisconnect (-cancel-on-disconnect or CANCEL_ON_DISCONNECT=1)
+// aborts the playing effect and drops queued ones when the socket drops,
+// so a reconnect (and any redelivered event) starts from idle. Off by
+// default: effects already received play out while the client reconnects.
+var cancelOnDisconnect bool
+
+func envDuration(k string, def time.Duration) time.Duration {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	log.Printf("%s=%q is not a duration; using %s", k, v, def)
+	return def
+}
+
+func keepaliveFromEnv(readDef, pingDef time.Duration) (read, ping time.Duration) {
+	read = envDuration("WS_READ_TIMEOUT", readDef)
+	ping = envDuration("WS_PING_INTERVAL", pingDef)
+	if ping >= read {
+		log.Printf("WS_PING_INTERVAL %s >= WS_READ_TIMEOUT %s; pinging every %s", ping, read, read/2)
+		ping = read / 2
+	}
+	return read, ping
+}
+
 // ---------- keep local config.json’s idle color in sync ----------
+// Only idle.color is touched; every other key (led and queue settings,
+// events, ...) is written back as it was.
 func writeIdleColorIntoLocalConfig(hexColor string) {
-	type idleCfg struct {
-		Color string `json:"color"`
-	}
-	type conf struct {
-		LedPin     int     `json:"ledPin"`
-		LedCount   int     `json:"ledCount"`
-		Brightness int     `json:"brightness"`
-		Idle       idleCfg `json:"idle"`
-	}
-	var c conf
-	_ = json.Unmarshal(must(os.ReadFile("config.json")), &c)
-	if c.Idle.Color == hexColor {
+	var c map[string]json.RawMessage
+	if err := json.Unmarshal(must(os.ReadFile("config.json")), &c); err != nil || c == nil {
+		c = map[string]json.RawMessage{}
+	}
+	var idle map[string]json.RawMessage
+	if err := json.Unmarshal(c["idle"], &idle); err != nil || idle == nil {
+		idle = map[string]json.RawMessage{}
+	}
+	var cur string
+	_ = json.Unmarshal(idle["color"], &cur)
+	if cur == hexColor {
 		return
 	}
-	c.Idle.Color = hexColor
+	idle["color"] = must(json.Marshal(hexColor))
+	c["idle"] = must(json.Marshal(idle))
 	_ = os.WriteFile("config.json", must(json.MarshalIndent(c, "", "  ")), 0644)
 	log.Printf("Updated local config.json idle.color to %s", hexColor)
 }
 
+// ---------- effect queue ----------
+// Events are queued for the effect worker without ever blocking the
+// websocket read loop. When the queue is full the oldest job is dropped;
+// with the "coalesce" policy a repeat of the newest queued event type also
+// replaces it instead of queuing behind it. Configured in config.json:
+//
+//	"queue": { "size": 32, "policy": "drop_oldest" | "coalesce" }
+const (
+	queueDropOldest = "drop_oldest"
+	queueCoalesce   = "coalesce"
+)
+
+type effectQueue struct {
+	mu     sync.Mutex
+	ready  chan struct{} // signalled when items goes non-empty
+	items  []effectJob
+	size   int
+	policy string
+}
+
+func newEffectQueue(size int, policy string) *effectQueue {
+	if size <= 0 {
+		size = 32
+	}
+	return &effectQueue{ready: make(chan struct{}, 1), size: size, policy: policy}
+}
+
+// push never blocks; it logs whatever it had to drop.
+func (q *effectQueue) push(job effectJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n := len(q.items); n > 0 && q.policy == queueCoalesce && q.items[n-1].event == job.event {
+		log.Printf("queue: coalesced repeated %q event", job.event)
+		q.items[n-1] = job
+		return
+	}
+	if len(q.items) >= q.size {
+		log.Printf("queue: full (%d), dropping oldest %q event", q.size, q.items[0].event)
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, job)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// clear drops every queued job and returns how many there were.
+func (q *effectQueue) clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.items)
+	q.items = nil
+	return n
+}
+
+// pop blocks until a job is queued.
+func (q *effectQueue) pop() effectJob {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			job := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return job
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// clientConfig is the client's own part of config.json (the LED settings
+// belong to ledcontrol).
+type clientConfig struct {
+	Queue struct {
+		Size   int    `json:"size"`
+		Policy string `json:"policy"`
+	} `json:"queue"`
+	Boot struct {
+		Effect string `json:"effect"` // shown at power-up until prefs arrive; "" = none
+		Color  string `json:"color"`
+	} `json:"boot"`
+	Local struct {
+		Port    int  `json:"port"`    // 0 = local control off
+		BindAll bool `json:"bindAll"` // listen on every interface, not just localhost
+	} `json:"local"`
+	Latency struct {
+		Count       int `json:"count"`       // LEDs showing it; 0 = latency indicator off
+		First       int `json:"first"`       // index of the first of them
+		IntervalSec int `json:"intervalSec"` // between measurements; 0 = 30
+		GoodMs      int `json:"goodMs"`      // at or under: green (0 = 100)
+		BadMs       int `json:"badMs"`       // at or over, or unreachable: red (0 = 1000)
+	} `json:"latency"`
+	APIBase string   `json:"apiBase"` // overridden by API_BASE
+	WSURL   string   `json:"wsUrl"`   // overridden by WS_URL; derived from the API base if unset
+	Servers []string `json:"servers"` // API bases to fail over to, in order; the first is primary if apiBase is unset
+}
+
+// configureEndpoints picks apiBase and wsURL: environment first, then
+// config.json, then the built-in defaults. Given only an API base, the
+// websocket URL is derived from it (https://host → wss://host/ws).
+// config.json "servers" become fallbacks after that primary.
+func configureEndpoints(c clientConfig) {
+	base := firstNonEmpty(os.Getenv("API_BASE"), c.APIBase)
+	ws := firstNonEmpty(os.Getenv("WS_URL"), c.WSURL)
+	fallbacks := c.Servers
+	if base == "" && ws == "" && len(fallbacks) > 0 {
+		base, fallbacks = strings.TrimSpace(fallbacks[0]), fallbacks[1:]
+	}
+	if base != "" {
+		apiBase = strings.TrimRight(base, "/")
+		if ws == "" {
+			ws = wsURLFor(apiBase)
+		}
+	}
+	if ws != "" {
+		wsURL = ws
+	}
+	servers = []endpoint{{apiBase, wsURL}}
+	for _, b := range fallbacks {
+		b = strings.TrimRight(strings.TrimSpace(b), "/")
+		if b == "" || slices.ContainsFunc(servers, func(e endpoint) bool { return e.api == b }) {
+			continue
+		}
+		servers = append(servers, endpoint{b, wsURLFor(b)})
+	}
+	serverIdx.Store(0)
+	log.Printf("Server: %s (ws %s)", apiBase, wsURL)
+	for _, e := range servers[1:] {
+		log.Printf("Fallback server: %s (ws %s)", e.api, e.ws)
+	}
+}
+
+// wsURLFor maps an http(s) API base to its websocket endpoint.
+func wsURLFor(base string) string {
+	switch {
+	case strings.HasPrefix(base, "https://"):
+		base = "wss://" + strings.TrimPrefix(base, "https://")
+	case strings.HasPrefix(base, "http://"):
+		base = "ws://" + strings.TrimPrefix(base, "http://")
+	}
+	return base + "/ws"
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func readClientConfig() clientConfig {
+	var c clientConfig
+	b, err := os.ReadFile("config.json")
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		log.Printf("client config: %v", err)
+	}
+	return c
+}
+
+// loadQueueConfig replaces the default queue with config.json's "queue"
+// settings. Call before startEffectWorker.
+func loadQueueConfig(c clientConfig) {
+	policy := strings.ToLower(strings.TrimSpace(c.Queue.Policy))
+	switch policy {
+	case "":
+		policy = queueDropOldest
+	case queueDropOldest, queueCoalesce:
+	default:
+		log.Printf("queue config: unknown policy %q, using %s", policy, queueDropOldest)
+		policy = queueDropOldest
+	}
+	jobs = newEffectQueue(c.Queue.Size, policy)
+	log.Printf("Effect queue: size=%d policy=%s", jobs.size, jobs.policy)
+}
+
+// ---------- local control ----------
+// For on-site tuning without internet: with "local": {"port": N} in
+// config.json the client serves POST /effect {effect,color,cycles}, queued
+// like a websocket event, and GET /status. Listens on localhost unless bindAll is set.
+func startLocalControl(c clientConfig) {
+	if c.Local.Port <= 0 {
+		return
+	}
+	host := "127.0.0.1"
+	if c.Local.BindAll {
+		host = ""
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(c.Local.Port))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /effect", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Effect string `json:"effect"`
+			Color  string `json:"color"`
+			Cycles int    `json:"cycles"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Effect == "" {
+			http.Error(w, "need json {effect,color,cycles}", http.StatusBadRequest)
+			return
+		}
+		enqueueEvent(WSMessage{Type: "local", Effect: req.Effect, ColorHex: req.Color, Cycles: req.Cycles})
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"busy":   ledcontrol.IsBusy(),
+			"effect": ledcontrol.CurrentEffect(),
+			"idle":   ledcontrol.CurrentIdle(),
+			"off":    stripOff.Load(),
+		})
+	})
+	go func() {
+		log.Printf("Local control listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("local control: %v", err)
+		}
+	}()
+}
+
 // ---------- prefs fetch & apply ----------
-func fetchPrefs(deviceID string) {
-	url := fmt.Sprintf("%s/devices/%s/prefs", apiBase, deviceID)
-	res, err := http.Get(url)
+// fetchPrefs loads and applies this device's prefs from the active server,
+// reporting whether it did. An "off" strip stays off.
+func fetchPrefs(deviceID string) (applied bool) {
+	url := fmt.Sprintf("%s/devices/%s/prefs", activeServer().api, deviceID)
+	res, err := httpClient.Get(url)
 	if err != nil {
 		log.Printf("fetch prefs: %v", err)
-		return
+		return false
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
 		b, _ := io.ReadAll(res.Body)
 		log.Printf("fetch prefs status %d: %s", res.StatusCode, string(b))
-		return
+		return false
 	}
-	var p DevicePrefs
+	// decode into a fresh value: a half-read body must not touch devicePrefs
+	var p prefs.Prefs
 	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
-		log.Printf("prefs decode: %v", err)
-		return
+		log.Printf("prefs decode: %v (keeping current prefs)", err)
+		return false
 	}
+	prefsMu.Lock()
+	p = mergePrefs(devicePrefs, p)
 	devicePrefs = p
+	prefsMu.Unlock()
+	if p.AccessiblePalette != nil {
+		ledcontrol.SetAccessiblePalette(*p.AccessiblePalette)
+	}
 
 	// Sync idle color for breathing effect (win.go reads config.json)
-	if p.Idle.Color != "" {
-		writeIdleColorIntoLocalConfig(p.Idle.Color)
-	}
+	setIdleColor(p.Idle.Color)
 	// Restart idle to pick up new effect/color
-	ledcontrol.StopBreathingEffect()
-	if strings.ToLower(strings.TrimSpace(p.Idle.Effect)) == "breath" ||
-		strings.ToLower(strings.TrimSpace(p.Idle.Effect)) == "runbreathingeffect" {
+	applyIdle()
+	log.Printf("Applied prefs: idle=%s %s, %d events", p.Idle.Effect, p.Idle.Color, len(p.Events))
+
+	// Remember what we're showing so a restart comes back to it
+	saveIdleState()
+	return true
+}
+
+// configUpdated refetches prefs after a config_updated notice. Like "on",
+// the notice turns an "off" strip back on; the boot and failover fetches
+// don't, so closing time survives a restart.
+func configUpdated(deviceID string) {
+	log.Println("Config update notice → refetching prefs")
+	wasOff := stripOff.Swap(false)
+	if !fetchPrefs(deviceID) && wasOff {
+		setStripOff(false) // on with the prefs we have
+	}
+}
+
+// mergePrefs lays a fetched prefs document over the current one. Whatever
+// the server sent wins, but parts it left out keep what we had: a response
+// without "events" doesn't wipe the event mappings (an explicit empty
+// object does clear them), and one with no idle effect doesn't blank the
+// idle.
+func mergePrefs(cur, got prefs.Prefs) prefs.Prefs {
+	if got.Events == nil && len(cur.Events) > 0 {
+		log.Printf("prefs: response has no events; keeping the %d we have", len(cur.Events))
+		got.Events = cur.Events
+	}
+	if strings.TrimSpace(got.Idle.Effect) == "" && cur.Idle.Effect != "" {
+		log.Printf("prefs: response has no idle effect; keeping %s", cur.Idle.Effect)
+		got.Idle = cur.Idle
+	}
+	if got.AccessiblePalette == nil {
+		got.AccessiblePalette = cur.AccessiblePalette
+	}
+	return got
+}
+
+// setIdle switches the idle straight from a "set_idle" message instead of
+// the prefs round trip. It is kept locally (config.json color, state.json)
+// so it survives a restart, but the next prefs fetch still overrides it.
+func setIdle(idle prefs.Idle) {
+	prefsMu.Lock()
+	if idle.Color == "" {
+		idle.Color = devicePrefs.Idle.Color
+	}
+	devicePrefs.Idle = idle
+	prefsMu.Unlock()
+	setIdleColor(idle.Color)
+	applyIdle()
+	saveIdleState()
+	log.Printf("Idle set live: %s %s", idle.Effect, idle.Color)
+}
+
+func saveIdleState() {
+	idle := currentPrefs().Idle
+	st := ledcontrol.IdleState{
+		Effect: idle.Effect, Color: idle.Color, ColorB: idle.ColorB,
+		Kelvin: idle.Kelvin, BPM: idle.BPM, PeriodSec: idle.PeriodSec,
+		Density: idle.Density, Palette: idle.Palette, Blend: idle.Blend, StepMs: idle.StepMs,
+		Off: stripOff.Load(),
+	}
+	if err := ledcontrol.SaveState(st); err != nil {
+		log.Printf("save idle state: %v", err)
+	}
+}
+
+// ---------- idle ----------
+func setIdleColor(hexColor string) {
+	if hexColor == "" {
+		return
+	}
+	writeIdleColorIntoLocalConfig(hexColor)
+	ledcontrol.SetIdleColor(hexColor)
+}
+
+// stripOff is set by an "off" message (closing time): the strip stays dark,
+// with no idle and no effects, until "on" or a config update. It survives
+// restarts through state.json.
+var stripOff atomic.Bool
+
+func setStripOff(off bool) {
+	stripOff.Store(off)
+	saveIdleState()
+	if off {
+		log.Println("Strip off: idle and effects suppressed until \"on\"")
+		ledcontrol.StopIdle()
+		ledcontrol.ClearLEDs()
+		return
+	}
+	log.Println("Strip on")
+	applyIdle()
+}
+
+// applyIdle (re)starts the configured idle effect; "off" and unknown ones
+// stay dark with no idle goroutine, so effects still fire and end on black.
+func applyIdle() {
+	finishBoot()
+	ledcontrol.StopIdle()
+	if stripOff.Load() || shuttingDown.Load() {
+		return
+	}
+	idle := currentPrefs().Idle
+	switch strings.ToLower(strings.TrimSpace(idle.Effect)) {
+	case "off":
+		ledcontrol.ClearLEDs() // whatever the last idle left lit
+	case "breath", "runbreathingeffect":
 		ledcontrol.RunBreathingEffect()
+	case "breath2":
+		ledcontrol.Breath2(parseHexColor(idle.Color), parseHexColor(idle.ColorB))
+	case "vumeter":
+		ledcontrol.VUMeter(nil, 20*time.Millisecond)
+	case "heartbeat":
+		ledcontrol.Heartbeat(parseHexColor(idle.Color), idle.BPM)
+	case "gradienttwinkle":
+		ledcontrol.GradientTwinkle(parseHexColor(idle.Color), parseHexColor(idle.ColorB), idle.Density)
+	case "palettecycle":
+		step := time.Duration(idle.StepMs) * time.Millisecond
+		ledcontrol.PaletteCycle(resolvePalette(idle.Palette), idle.Blend, step)
+	case "huedrift":
+		ledcontrol.HueDrift(time.Duration(idle.PeriodSec) * time.Second)
+	case "warm":
+		kelvin := idle.Kelvin
+		if kelvin == 0 {
+			kelvin = 2700
+		}
+		ledcontrol.SolidWarm(kelvin)
 	}
-	log.Printf("Applied prefs: idle=%s %s, %d events", p.Idle.Effect, p.Idle.Color, len(p.Events))
+}
+
+// restoreIdle brings back the last saved idle so the strip isn't dark
+// while the server cold-starts. A corrupt state file falls back to defaults.
+func restoreIdle() {
+	st, err := ledcontrol.LoadState()
+	if err != nil {
+		log.Printf("restore idle state: %v (using defaults)", err)
+	}
+	prefsMu.Lock()
+	devicePrefs.Idle.Effect, devicePrefs.Idle.Color, devicePrefs.Idle.ColorB = st.Effect, st.Color, st.ColorB
+	devicePrefs.Idle.Kelvin, devicePrefs.Idle.BPM, devicePrefs.Idle.PeriodSec = st.Kelvin, st.BPM, st.PeriodSec
+	devicePrefs.Idle.Density = st.Density
+	devicePrefs.Idle.Palette, devicePrefs.Idle.Blend, devicePrefs.Idle.StepMs = st.Palette, st.Blend, st.StepMs
+	prefsMu.Unlock()
+	stripOff.Store(st.Off)
+	setIdleColor(st.Color)
+	log.Printf("Restored idle: %s %s", st.Effect, st.Color)
+	if booting() {
+		return // shown once prefs arrive (or fail to)
+	}
+	applyIdle()
 }
 
 // ---------- event resolution ----------
-func resolvePrefs(msg WSMessage) (effect string, color uint32, cycles int) {
+
+// pickRand chooses random effects and colors. -seed fixes it so a run can
+// be repeated; otherwise it's seeded from the clock.
+var (
+	pickMu   sync.Mutex
+	pickRand = rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), 0))
+)
+
+func seedPicks(seed uint64) {
+	pickMu.Lock()
+	pickRand = rand.New(rand.NewPCG(seed, 0))
+	pickMu.Unlock()
+}
+
+// pick returns one of pool at random ("" for an empty pool).
+func pick(pool []string) string {
+	if len(pool) == 0 {
+		return ""
+	}
+	pickMu.Lock()
+	defer pickMu.Unlock()
+	return pool[pickRand.IntN(len(pool))]
+}
+
+// minIntensity is the least an event's intensity scales an effect down to.
+const minIntensity = 0.1
+
+func resolvePrefs(msg WSMessage) (job effectJob) {
 	// start from device prefs by event type
-	if p, ok := devicePrefs.Events[strings.ToLower(strings.TrimSpace(msg.Type))]; ok {
-		effect = strings.ToLower(strings.TrimSpace(p.Effect))
-		color = parseHexColor(p.Color)
-		cycles = p.Cycles
+	dp := currentPrefs()
+	p, ok := dp.Events[strings.ToLower(strings.TrimSpace(msg.Type))]
+	p = p.Active(time.Now()) // an expired override falls back to the base event
+	if ok {
+		job.effect = strings.ToLower(strings.TrimSpace(p.Effect))
+		job.color = parseHexColor(p.Color)
+		if c := pick(p.Colors); c != "" {
+			job.color = parseHexColor(c)
+		}
+		job.cycles = p.Cycles
+		job.brightness = p.Brightness
+		job.palette = resolvePalette(p.Palette)
+		if job.palette == nil {
+			job.palette = parseColors(p.Colors)
+		}
+		job.text = p.Text
+		job.hold = p.ResumeIdle != nil && !*p.ResumeIdle
+		job.curve = resolveCurve(p.FadeCurve)
+		job.headGlow = p.HeadGlow
+		job.mirror = p.Mirror
+	}
+	// server overrides; a locked device keeps its own look
+	locked := dp.Locked
+	if locked && (msg.Effect != "" || msg.ColorHex != "" || msg.Palette != "") {
+		log.Printf("Locked: ignoring effect/color/palette overrides on %s", msg.Type)
 	}
-	// server overrides
-	if msg.Effect != "" {
-		effect = strings.ToLower(strings.TrimSpace(msg.Effect))
+	if msg.Effect != "" && !locked {
+		job.effect = strings.ToLower(strings.TrimSpace(msg.Effect))
 	}
-	if msg.ColorHex != "" {
-		color = parseHexColor(msg.ColorHex)
+	if msg.ColorHex != "" && !locked {
+		job.color = parseHexColor(msg.ColorHex)
 	}
 	if msg.Cycles > 0 {
-		cycles = msg.Cycles
+		job.cycles = msg.Cycles
+	}
+	if msg.Brightness != nil {
+		job.brightness = msg.Brightness
+	}
+	if msg.Palette != "" && !locked {
+		job.palette = resolvePalette(msg.Palette)
+	}
+	if msg.Text != "" {
+		job.text = msg.Text
+	}
+	if msg.FadeCurve != "" {
+		job.curve = resolveCurve(msg.FadeCurve)
+	}
+	if msg.HeadGlow > 0 {
+		job.headGlow = msg.HeadGlow
+	}
+	if msg.Mirror {
+		job.mirror = true
+	}
+	if msg.StartAt > 0 {
+		job.startAt = time.UnixMilli(msg.StartAt)
+	}
+	if msg.DurationMs > 0 {
+		job.duration = time.Duration(msg.DurationMs) * time.Millisecond
+	}
+	job.intensity = 1
+	if msg.Intensity != nil {
+		// floor it so a tiny deal still shows something
+		job.intensity = max(minIntensity, min(*msg.Intensity, 1))
+	}
+
+	// "random" draws from the event's pool, or from every show effect
+	if job.effect == prefs.RandomEffect {
+		pool := p.Effects
+		if len(pool) == 0 {
+			pool = ledcontrol.ShowEffectNames()
+		}
+		job.effect = strings.ToLower(strings.TrimSpace(pick(pool)))
+		log.Printf("Random effect for %s: %s", msg.Type, job.effect)
 	}
 
 	// fallbacks
-	if effect == "" {
-		effect = "celebrate_legacy"
+	if job.effect == "" {
+		job.effect = "celebrate_legacy"
 	}
-	if color == 0 {
-		color = 0x00FF00
+	if job.color == 0 {
+		job.color = 0x00FF00
 	}
-	if cycles <= 0 {
-		cycles = 1
+	if job.cycles <= 0 {
+		job.cycles = 1
 	}
 	return
 }
 
-// ---------- WebSocket client ----------
-func connectToWebSocket() {
-	// set your deployed URLs
-	const wsURL = "wss://webhook-listener-2i7r.onrender.com/ws"
+func resolveCurve(name string) frames.Curve {
+	c, ok := frames.ParseCurve(strings.ToLower(strings.TrimSpace(name)))
+	if !ok {
+		log.Printf("unknown fade curve %q, using linear", name)
+	}
+	return c
+}
+
+func resolvePalette(name string) []uint32 {
+	if strings.TrimSpace(name) == "" {
+		return nil
+	}
+	colors, ok := ledcontrol.Palette(name)
+	if !ok {
+		log.Printf("unknown palette %q; using the effect's default colors", name)
+	}
+	return colors
+}
 
+// parseColors turns a prefs colors list into a palette, skipping entries
+// that don't parse (the server validates them, but prefs can be old).
+func parseColors(hex []string) []uint32 {
+	var out []uint32
+	for _, h := range hex {
+		c := parseHexColor(h)
+		if c == 0 && strings.TrimPrefix(strings.TrimSpace(h), "#") != "000000" {
+			log.Printf("prefs colors: skipping %q (want #RRGGBB)", h)
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// ---------- latency indicator ----------
+// With "latency": {"count": N} in config.json, N LEDs from "first" show the
+// round trip to the active server's /healthz, measured every intervalSec:
+// green when fast, through yellow, to red when slow or unreachable. They
+// pulse bright on each measurement, then settle at half brightness.
+func startLatencyIndicator(c clientConfig) {
+	l := c.Latency
+	if l.Count <= 0 {
+		return
+	}
+	every := time.Duration(l.IntervalSec) * time.Second
+	if every <= 0 {
+		every = 30 * time.Second
+	}
+	good, bad := time.Duration(l.GoodMs)*time.Millisecond, time.Duration(l.BadMs)*time.Millisecond
+	if good <= 0 {
+		good = 100 * time.Millisecond
+	}
+	if bad <= good {
+		bad = max(time.Second, good*2)
+	}
+	log.Printf("Latency indicator: LEDs %d..%d every %s (green <= %s, red >= %s)", l.First, l.First+l.Count-1, every, good, bad)
+	ledcontrol.SafeGo("latency indicator", func() {
+		for ; ; time.Sleep(every) {
+			rtt, err := measureRTT()
+			hue := 0.0 // red
+			if err != nil {
+				log.Printf("latency: %v", err)
+			} else {
+				hue = 120 * (1 - math.Min(math.Max(float64(rtt-good)/float64(bad-good), 0), 1))
+			}
+			ledcontrol.SetIndicator(l.First, l.Count, frames.HSVToRGB(hue, 1, 1))
+			time.Sleep(200 * time.Millisecond)
+			ledcontrol.SetIndicator(l.First, l.Count, frames.HSVToRGB(hue, 1, 0.5))
+		}
+	})
+}
+
+// measureRTT times one GET of the active server's /healthz.
+func measureRTT() (time.Duration, error) {
+	start := time.Now()
+	res, err := httpClient.Get(activeServer().api + "/healthz")
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("healthz status %d", res.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+// ---------- WebSocket client ----------
+// connectToWebSocket keeps a socket to the active server open, reconnecting
+// (and failing over) until ctx is done.
+func connectToWebSocket(ctx context.Context) {
 	ident, err := loadIdent() // reads client.json {deviceId, deviceSecret}
 	if err != nil {
 		log.Fatalf("identity error: %v", err)
 	}
 
-	for {
+	failures := 0
+	fetchedFrom := serverIdx.Load() // main fetched prefs from the primary
+	for ctx.Err() == nil {
+		ws := activeServer().ws
 		ts := fmt.Sprintf("%d", time.Now().Unix())
 		hdr := http.Header{
 			"X-Device-ID": []string{ident.DeviceID},
@@ -205,39 +902,73 @@ func connectToWebSocket() {
 			"X-Auth-Sig":  []string{sign(ident.DeviceID, ident.DeviceSecret, ts)},
 		}
 
-		d := *websocket.DefaultDialer
-		c, resp, err := d.Dial(wsURL, hdr)
+		c, resp, err := dialer.DialContext(ctx, ws, hdr)
 		if err != nil {
 			// Print server’s actual response to see why the handshake failed
 			if resp != nil {
 				body, _ := io.ReadAll(resp.Body)
 				_ = resp.Body.Close()
-				log.Printf("WS connect failed (%s): HTTP %d %s body=%q", wsURL, resp.StatusCode, resp.Status, string(body))
+				log.Printf("WS connect failed (%s): HTTP %d %s body=%q", ws, resp.StatusCode, resp.Status, string(body))
 			} else {
-				log.Printf("WS connect failed: %v", err)
+				log.Printf("WS connect failed (%s): %v", ws, err)
+			}
+			if failures++; failures >= failoverAfter {
+				failures = 0
+				nextServer()
+			}
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
 			}
-			time.Sleep(5 * time.Second)
 			continue
 		}
+		failures = 0
 
-		log.Println("Connected to WebSocket server as", ident.DeviceID)
+		log.Printf("Connected to WebSocket server %s as %s", ws, ident.DeviceID)
+		if idx := serverIdx.Load(); idx != fetchedFrom {
+			fetchedFrom = idx
+			fetchPrefs(ident.DeviceID) // the new server may hold different prefs
+		}
+		if p := c.Subprotocol(); p != wsSubprotocol {
+			log.Printf("Server did not accept subprotocol %s (got %q); assuming an older server", wsSubprotocol, p)
+		}
+		sendHello(c)
+		stop := context.AfterFunc(ctx, func() { _ = c.Close() })
 		handleMessages(c, ident)
+		stop()
 		// handleMessages returns on disconnect; loop will retry
 	}
 }
 
+func sendHello(c *websocket.Conn) {
+	h := Hello{Version: version, Effects: ledcontrol.EffectNames(), LedCount: ledcontrol.LedCount()}
+	payload, _ := json.Marshal(h)
+	_ = c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := c.WriteJSON(Envelope{V: protoVersion, Type: "hello", Payload: payload}); err != nil {
+		log.Printf("send hello: %v", err)
+	}
+	_ = c.SetWriteDeadline(time.Time{})
+}
+
 func handleMessages(c *websocket.Conn, ident ClientIdent) {
 	defer c.Close()
 
 	// keepalive
 	c.SetReadLimit(1 << 20)
-	_ = c.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.SetPongHandler(func(string) error { return c.SetReadDeadline(time.Now().Add(60 * time.Second)) })
+	_ = c.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	c.SetPongHandler(func(string) error { return c.SetReadDeadline(time.Now().Add(wsReadTimeout)) })
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		t := time.NewTicker(30 * time.Second)
+		t := time.NewTicker(wsPingInterval)
 		defer t.Stop()
-		for range t.C {
-			_ = c.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second))
+		for {
+			select {
+			case <-t.C:
+				_ = c.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second))
+			case <-done:
+				return
+			}
 		}
 	}()
 
@@ -245,64 +976,440 @@ func handleMessages(c *websocket.Conn, ident ClientIdent) {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
 			log.Println("WebSocket connection lost, reconnecting...")
+			if cancelOnDisconnect {
+				cancelEffects()
+			}
 			return
 		}
 
-		// config push
-		if string(raw) == `{"type":"config_updated"}` || strings.Contains(string(raw), `"config_updated"`) {
-			log.Println("Config update notice → refetching prefs")
-			fetchPrefs(ident.DeviceID)
+		var env Envelope
+		if err := json.Unmarshal(raw, &env); err == nil && env.V > 0 {
+			handleEnvelope(c, env, ident)
 			continue
 		}
+		legacyMessage(raw, ident)
+	}
+}
 
-		// JSON event?
+// cancelEffects drops queued effects and cuts the playing one short; the
+// worker then resumes idle as after any effect.
+func cancelEffects() {
+	n := jobs.clear()
+	if cur := ledcontrol.CurrentEffect(); cur != "" || n > 0 {
+		log.Printf("Disconnected: cancelling %q and %d queued effect(s)", cur, n)
+	}
+	ledcontrol.AbortEffect()
+}
+
+// handleEnvelope runs on the read goroutine; the only other writer on c is
+// the keepalive's WriteControl, so replies can go straight out.
+func handleEnvelope(c *websocket.Conn, env Envelope, ident ClientIdent) {
+	switch env.Type {
+	case "config_updated":
+		configUpdated(ident.DeviceID)
+	case "event":
 		var msg WSMessage
-		if err := json.Unmarshal(raw, &msg); err == nil && (msg.Type != "" || msg.Effect != "") {
-			effect, color, cycles := resolvePrefs(msg)
-			log.Printf("Event=%s → effect=%s color=%06X cycles=%d", msg.Type, effect, color, cycles)
-			jobs <- effectJob{effect, color, cycles}
-			continue
+		if err := json.Unmarshal(env.Payload, &msg); err != nil || (msg.Type == "" && msg.Effect == "") {
+			log.Printf("Ignoring malformed event payload: %s", env.Payload)
+			return
+		}
+		enqueueEvent(msg)
+	case "off":
+		setStripOff(true)
+	case "on", "resume_idle":
+		if !stripOff.Load() && ledcontrol.IdleRunning() {
+			log.Println("Strip already on; idle left running")
+			return
+		}
+		setStripOff(false)
+	case "set_idle":
+		var idle prefs.Idle
+		if err := json.Unmarshal(env.Payload, &idle); err != nil || idle.Effect == "" {
+			log.Printf("Ignoring malformed set_idle payload: %s", env.Payload)
+			return
+		}
+		setIdle(idle)
+	case "count":
+		var cnt struct {
+			Value int    `json:"value"`
+			Color string `json:"color"`
+		}
+		if err := json.Unmarshal(env.Payload, &cnt); err != nil || cnt.Value < 0 {
+			log.Printf("Ignoring malformed count payload: %s", env.Payload)
+			return
+		}
+		color := parseHexColor(cnt.Color)
+		if color == 0 {
+			color = 0x00FF00
 		}
+		// held, so the number stays up until the next event
+		log.Printf("Count → %d", cnt.Value)
+		jobs.push(effectJob{event: "count", effect: "count", color: color, value: cnt.Value, hold: true})
+	case "frame":
+		var f struct {
+			Frame string `json:"frame"`
+		}
+		if err := json.Unmarshal(env.Payload, &f); err != nil {
+			log.Printf("Ignoring malformed frame payload: %v", err)
+			return
+		}
+		showFrame(f.Frame)
+	case "get_frame":
+		sendFrame(c)
+	case "stack_reset":
+		// a message, not an effect, so no random pick or self-test can
+		// erase the day's count
+		ledcontrol.ResetStack()
+	default:
+		log.Printf("Ignoring unknown message type %q (v%d)", env.Type, env.V)
+	}
+}
 
-		// plain text event (e.g., "deal_won")
-		text := strings.ToLower(strings.TrimSpace(string(raw)))
-		if text != "" {
-			effect, color, cycles := resolvePrefs(WSMessage{Type: text})
-			log.Printf("Event=%s → effect=%s color=%06X cycles=%d", text, effect, color, cycles)
-			jobs <- effectJob{effect, color, cycles}
+// legacyMessage understands the pre-envelope bare messages: a JSON event
+// object, {"type":"config_updated"}, or a plain-text event name. Anything
+// that parses as JSON is never taken for an event name, so a stray object
+// or array can't be lowercased into a bogus event.
+func legacyMessage(raw []byte, ident ClientIdent) {
+	if json.Valid(raw) {
+		var msg WSMessage
+		switch err := json.Unmarshal(raw, &msg); {
+		case err != nil:
+			log.Printf("Ignoring JSON message that is not an object: %.200s", raw)
+		case msg.Type == "config_updated":
+			configUpdated(ident.DeviceID)
+		case msg.Type != "" || msg.Effect != "":
+			enqueueEvent(msg)
+		default:
+			log.Printf("Ignoring JSON message with no type or effect: %.200s", raw)
 		}
+		return
+	}
+
+	// plain text event (e.g., "deal_won")
+	text := strings.ToLower(strings.TrimSpace(string(raw)))
+	switch text {
+	case "":
+	case "config_updated":
+		configUpdated(ident.DeviceID)
+	default:
+		enqueueEvent(WSMessage{Type: text})
+	}
+}
+
+func enqueueEvent(msg WSMessage) {
+	event := strings.ToLower(strings.TrimSpace(msg.Type))
+	if left := coolingDown(event); left > 0 {
+		log.Printf("Event=%s dropped: cooling down for another %s", msg.Type, left.Round(time.Millisecond))
+		return
+	}
+	job := resolvePrefs(msg)
+	job.event = event
+	log.Printf("Event=%s → effect=%s color=%06X cycles=%d", msg.Type, job.effect, job.color, job.cycles)
+	jobs.push(job)
+}
+
+// lastFired is when each event type last got past its cooldown. Unlike
+// queue coalescing this is purely time-based: with "cooldownMs" in an
+// event's prefs, repeats inside the window never reach the queue.
+var (
+	cooldownMu sync.Mutex
+	lastFired  = map[string]time.Time{}
+)
+
+// coolingDown returns how long event is still cooling down, or 0 when it
+// may fire (in which case this firing starts a new window).
+func coolingDown(event string) time.Duration {
+	window := time.Duration(currentPrefs().Events[event].Active(time.Now()).CooldownMs) * time.Millisecond
+	if window <= 0 {
+		return 0
+	}
+	cooldownMu.Lock()
+	defer cooldownMu.Unlock()
+	now := time.Now()
+	if last, ok := lastFired[event]; ok && now.Sub(last) < window {
+		return window - now.Sub(last)
 	}
+	lastFired[event] = now
+	return 0
+}
+
+// ---------- raw frames ----------
+// Streamed frames pause the idle; once they stop arriving for
+// frameIdleAfter the idle comes back.
+const frameIdleAfter = 2 * time.Second
+
+var (
+	frameMu    sync.Mutex
+	frameTimer *time.Timer
+)
+
+// frameReplyEvery rate-limits get_frame replies; requests in between are
+// dropped, and the server keeps the last one for its callers.
+const frameReplyEvery = time.Second
+
+var lastFrameReply time.Time // read goroutine only
+
+// FrameSnapshot answers get_frame: the strip as last rendered, "RRGGBB"
+// per LED from LED 0.
+type FrameSnapshot struct {
+	Leds     string `json:"leds"`
+	LedCount int    `json:"ledCount"`
+	At       int64  `json:"at"` // unix millis
+}
+
+func sendFrame(c *websocket.Conn) {
+	if time.Since(lastFrameReply) < frameReplyEvery {
+		log.Printf("get_frame: rate-limited, dropped")
+		return
+	}
+	lastFrameReply = time.Now()
+	leds := ledcontrol.Snapshot()
+	var sb strings.Builder
+	sb.Grow(6 * len(leds))
+	for _, v := range leds {
+		fmt.Fprintf(&sb, "%06X", v&0xFFFFFF)
+	}
+	payload, _ := json.Marshal(FrameSnapshot{Leds: sb.String(), LedCount: len(leds), At: lastFrameReply.UnixMilli()})
+	_ = c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := c.WriteJSON(Envelope{V: protoVersion, Type: "frame_snapshot", Payload: payload}); err != nil {
+		log.Printf("send frame: %v", err)
+	}
+	_ = c.SetWriteDeadline(time.Time{})
+}
+
+func showFrame(b64 string) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(raw)%4 != 0 {
+		log.Printf("Ignoring bad frame: not base64 uint32s")
+		return
+	}
+	buf := make([]uint32, len(raw)/4)
+	for i := range buf {
+		buf[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+	if err := ledcontrol.ShowFrame(buf); err != nil {
+		log.Printf("frame: %v", err)
+		return
+	}
+
+	frameMu.Lock()
+	defer frameMu.Unlock()
+	if frameTimer == nil {
+		frameTimer = time.AfterFunc(frameIdleAfter, func() {
+			frameMu.Lock()
+			frameTimer = nil
+			frameMu.Unlock()
+			applyIdle()
+		})
+		return
+	}
+	frameTimer.Reset(frameIdleAfter)
 }
 
 // serialize effects; pause idle during effect, then resume
 func startEffectWorker() {
-	go func() {
-		for job := range jobs {
-			ledcontrol.StopBreathingEffect()
-			ledcontrol.RunEffectByName(job.effect, job.color, job.cycles)
-			// resume idle if configured as breath
-			if strings.ToLower(strings.TrimSpace(devicePrefs.Idle.Effect)) == "breath" ||
-				strings.ToLower(strings.TrimSpace(devicePrefs.Idle.Effect)) == "runbreathingeffect" {
-				ledcontrol.RunBreathingEffect()
+	ledcontrol.SafeGo("effect worker", func() {
+		for {
+			job := jobs.pop()
+			if shuttingDown.Load() {
+				continue
+			}
+			if stripOff.Load() {
+				log.Printf("Strip off: skipping %s", job.effect)
+				continue
+			}
+			waitForStart(job)
+			if ledcontrol.OverlaysIdle(job.effect) {
+				ledcontrol.RunSafe("effect "+job.effect, func() {
+					ledcontrol.RunEffectWith(job.effect, ledcontrol.Params{Color: job.color, Duration: job.duration})
+				})
+				continue
+			}
+			ledcontrol.StopIdle()
+			if job.brightness != nil {
+				ledcontrol.SetBrightness(*job.brightness)
 			}
+			params := ledcontrol.Params{Color: job.color, Cycles: job.cycles, Palette: job.palette, Text: job.text, Hold: job.hold, Curve: job.curve, HeadGlow: job.headGlow, Mirror: job.mirror, Value: job.value, Intensity: job.intensity, Duration: job.duration}
+			panicked := ledcontrol.RunSafe("effect "+job.effect, func() { ledcontrol.RunEffectWith(job.effect, params) })
+			if job.brightness != nil {
+				ledcontrol.ResetBrightness()
+			}
+			// resume idle unless the event holds its final frame (a crashed
+			// effect has no final frame worth holding)
+			if job.hold && !panicked {
+				log.Printf("Holding %s until the next event", job.effect)
+				continue
+			}
+			applyIdle()
 		}
+	})
+}
+
+// maxStartWait bounds how long a job waits for its startAt, so a bad clock
+// (ours or the server's) can't park the queue.
+const maxStartWait = time.Minute
+
+// waitForStart sleeps, with the idle still showing, until job.startAt.
+// Synchronized starts assume this clock is NTP-synced; a late job (the
+// queue was busy, or the clock is behind) runs right away.
+func waitForStart(job effectJob) {
+	if job.startAt.IsZero() {
+		return
+	}
+	wait := time.Until(job.startAt)
+	switch {
+	case wait <= 0:
+		log.Printf("%s: %s past its start time, running now", job.effect, (-wait).Round(time.Millisecond))
+	case wait > maxStartWait:
+		log.Printf("%s: start time %s away, waiting only %s", job.effect, wait.Round(time.Second), maxStartWait)
+		time.Sleep(maxStartWait)
+	default:
+		time.Sleep(wait)
+	}
+}
+
+// ---------- boot effect ----------
+// A short config.json "boot" effect plays right after LED init so a
+// freshly powered Pi visibly lights up while the server cold-starts. Real
+// prefs (or giving up on them) interrupt it. bootDone closes when it
+// ends; it is nil once finished (or if there is none). finishBoot runs from
+// the read loop, the worker and timers alike, so both go under bootMu.
+var (
+	bootMu   sync.Mutex
+	bootDone chan struct{}
+)
+
+// booting reports whether the boot effect has yet to be finished.
+func booting() bool {
+	bootMu.Lock()
+	defer bootMu.Unlock()
+	return bootDone != nil
+}
+
+func startBootEffect(c clientConfig) {
+	effect := strings.ToLower(strings.TrimSpace(c.Boot.Effect))
+	if effect == "" {
+		return
+	}
+	color := parseHexColor(c.Boot.Color)
+	if color == 0 {
+		color = 0x0000FF
+	}
+	log.Printf("Boot effect: %s #%06X", effect, color)
+	done := make(chan struct{})
+	bootMu.Lock()
+	bootDone = done
+	bootMu.Unlock()
+	go func() {
+		defer close(done)
+		ledcontrol.RunEffectWith(effect, ledcontrol.Params{Color: color, Cycles: 1})
+	}()
+}
+
+// finishBoot cuts the boot effect short (if still playing) and waits for
+// it; concurrent callers all wait until it is over.
+func finishBoot() {
+	bootMu.Lock()
+	defer bootMu.Unlock()
+	if bootDone == nil {
+		return
+	}
+	ledcontrol.AbortEffect()
+	<-bootDone
+	bootDone = nil
+}
+
+// ---------- shutdown ----------
+// shuttingDown stops new effects and idles while the strip fades out.
+var shuttingDown atomic.Bool
+
+// shutdownOnSignal fades the strip out and exits on SIGINT/SIGTERM instead
+// of leaving whatever frame was up lit on a dead process.
+func shutdownOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("%v: fading out", s)
+		shuttingDown.Store(true)
+		ledcontrol.Shutdown()
+		os.Exit(0)
 	}()
 }
 
+// ---------- self-test ----------
+// runSelfTest shows every registered effect once, each in its own color
+// and cut off after each, to check wiring, LED count and brightness.
+func runSelfTest(each time.Duration) {
+	names := slices.DeleteFunc(ledcontrol.EffectNames(), func(n string) bool {
+		return n == "testpattern" || n == "stack" // shown first; would add a dot to the saved bar
+	})
+	fmt.Printf("Self-test: %d LEDs, %d effects, up to %s each\n", ledcontrol.LedCount(), len(names), each)
+	ledcontrol.SetMaxEffectDuration(each)
+	fmt.Println("  test pattern: LED 0/1/2 red/green/blue, every 10th white, last LED yellow")
+	ledcontrol.RunEffectByName("testpattern", 0, 1)
+	for i, name := range names {
+		color := frames.Wheel(i * 256 / len(names))
+		fmt.Printf("  [%d/%d] %s #%06X\n", i+1, len(names), name, color)
+		ledcontrol.RunEffectByName(name, color, 1)
+	}
+	ledcontrol.SetMaxEffectDuration(0)
+	ledcontrol.ClearLEDs()
+	ledcontrol.CleanupLEDs()
+	fmt.Println("Self-test done")
+}
+
 // ---------- main ----------
 func main() {
-	log.Println("Starting WebSocket Client...")
+	simulate := flag.Bool("simulate", os.Getenv("LED_SIM") == "1", "use a logging LED driver instead of GPIO (or LED_SIM=1)")
+	selftest := flag.Bool("selftest", false, "run every effect once, then exit (no server needed)")
+	selftestEach := flag.Duration("selftest-each", 3*time.Second, "max time per effect in -selftest")
+	seed := flag.Uint64("seed", 0, "seed for random effect/color picks, for repeatable runs (0 = from the clock)")
+	debug := flag.Bool("debug", os.Getenv("LED_DEBUG") == "1", "log a summary of the rendered frame about once a second (or LED_DEBUG=1)")
+	flag.BoolVar(&cancelOnDisconnect, "cancel-on-disconnect", os.Getenv("CANCEL_ON_DISCONNECT") == "1", "abort the playing effect and drop queued ones when the server connection drops (or CANCEL_ON_DISCONNECT=1)")
+	flag.Parse()
+	if *seed != 0 {
+		seedPicks(*seed)
+	}
 
-	// 1) fetch & apply prefs (sets config.json idle color; starts idle if breath)
+	log.Printf("Starting WebSocket Client %s...", version)
+	if *simulate {
+		log.Println("Simulation mode: no LED hardware will be touched")
+		ledcontrol.SetSimulated(true)
+	}
+	ledcontrol.SetDebug(*debug)
+	if err := ledcontrol.EnsureInit(); err != nil {
+		// not fatal: effects retry init and log on their own
+		log.Printf("LED init: %v", err)
+	}
+	if *selftest {
+		runSelfTest(*selftestEach)
+		return
+	}
+
+	cfg := readClientConfig()
+	configureEndpoints(cfg)
+	startBootEffect(cfg)
+
+	// 1) restore last idle, then fetch & apply prefs (sets config.json idle color; starts idle if breath)
 	id, err := loadIdent()
 	if err != nil {
 		log.Fatalf("identity error: %v", err)
 	}
+	restoreIdle()
 	fetchPrefs(id.DeviceID)
+	if booting() {
+		applyIdle() // prefs fetch failed: fall back to the restored idle
+	}
+
+	shutdownOnSignal()
 
 	// 2) start effect worker
+	loadQueueConfig(cfg)
 	startEffectWorker()
+	startLocalControl(cfg)
+	startLatencyIndicator(cfg)
 
 	// 3) connect WS (auth)
-	connectToWebSocket()
+	connectToWebSocket(context.Background())
 }
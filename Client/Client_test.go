@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"celebration/ledcontrol"
+	"celebration/prefs"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	ledcontrol.SetSimulated(true)
+	os.Exit(m.Run())
+}
+
+// sandbox runs the test in a temp dir with a small config.json, since the
+// client reads and writes config.json and state.json in the working dir.
+func sandbox(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("config.json", []byte(`{"ledCount": 8}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ledcontrol.StopIdle)
+}
+
+// serveOnly points the client at a test server answering every request
+// with status and body.
+func serveOnly(t *testing.T, status int, body string) {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	oldClient, oldServers := httpClient, servers
+	httpClient, servers = ts.Client(), []endpoint{{api: ts.URL}}
+	serverIdx.Store(0)
+	t.Cleanup(func() { httpClient, servers = oldClient, oldServers })
+}
+
+// withPrefs sets devicePrefs to a known document for the test.
+func withPrefs(t *testing.T) {
+	t.Helper()
+	old := devicePrefs
+	devicePrefs = prefs.Prefs{
+		Idle:   prefs.Idle{Effect: "off", Color: "#0000FF"},
+		Events: map[string]prefs.Event{"deal_won": {Effect: "blink", Color: "#00FF00"}},
+	}
+	t.Cleanup(func() { devicePrefs = old })
+}
+
+func TestFetchPrefs(t *testing.T) {
+	cases := []struct {
+		name       string
+		status     int
+		body       string
+		wantEvents []string
+		wantIdle   string
+	}{
+		{"server error keeps prefs", http.StatusInternalServerError, `{"error":"boom"}`, []string{"deal_won"}, "#0000FF"},
+		{"decode error keeps prefs", http.StatusOK, `{"idle":{"effect":"off",`, []string{"deal_won"}, "#0000FF"},
+		{"missing events keep events", http.StatusOK, `{"idle":{"effect":"off","color":"#FF0000"}}`, []string{"deal_won"}, "#FF0000"},
+		{"empty events clear events", http.StatusOK, `{"idle":{"effect":"off","color":"#FF0000"},"events":{}}`, nil, "#FF0000"},
+		{"full response replaces", http.StatusOK, `{"idle":{"effect":"off","color":"#FF0000"},"events":{"ticket":{"effect":"wipe"}}}`, []string{"ticket"}, "#FF0000"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sandbox(t)
+			withPrefs(t)
+			serveOnly(t, tc.status, tc.body)
+
+			fetchPrefs("dev-a")
+
+			p := currentPrefs()
+			if p.Idle.Color != tc.wantIdle {
+				t.Errorf("idle color %q, want %q", p.Idle.Color, tc.wantIdle)
+			}
+			if len(p.Events) != len(tc.wantEvents) {
+				t.Fatalf("events %v, want %v", p.Events, tc.wantEvents)
+			}
+			for _, e := range tc.wantEvents {
+				if _, ok := p.Events[e]; !ok {
+					t.Errorf("event %q missing from %v", e, p.Events)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefsConcurrentAccess(t *testing.T) {
+	sandbox(t)
+	withPrefs(t)
+	serveOnly(t, http.StatusOK, `{"idle":{"effect":"off","color":"#FF0000"},"events":{"deal_won":{"effect":"wipe","cooldownMs":5}}}`)
+
+	// the read loop swaps prefs while the worker and the frame timer read them
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				switch i {
+				case 0:
+					fetchPrefs("dev-a")
+					setIdle(prefs.Idle{Effect: "off", Color: "#00FF00"})
+				case 1:
+					resolvePrefs(WSMessage{Type: "deal_won"})
+					coolingDown("deal_won")
+				case 2:
+					applyIdle()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLegacyMessage(t *testing.T) {
+	cases := []struct {
+		name      string
+		raw       string
+		wantEvent string // "" = nothing queued
+		wantFx    string
+	}{
+		{"JSON object that isn't an event", `{"config":{"ledCount":30}}`, "", ""},
+		{"JSON array", `["deal_won"]`, "", ""},
+		{"JSON string", `"deal_won"`, "", ""},
+		{"bare word", "deal_won", "deal_won", "blink"},
+		{"bare word, padded and mixed case", "  Deal_Won\n", "deal_won", "blink"},
+		{"event object", `{"type":"deal_won"}`, "deal_won", "blink"},
+		{"event object with its own effect", `{"type":"deal_won","effect":"wipe"}`, "deal_won", "wipe"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			withPrefs(t)
+			old := jobs
+			jobs = newEffectQueue(8, queueDropOldest)
+			t.Cleanup(func() { jobs = old })
+
+			legacyMessage([]byte(tc.raw), ClientIdent{DeviceID: "dev-a"})
+
+			jobs.mu.Lock()
+			queued := jobs.items
+			jobs.mu.Unlock()
+			switch {
+			case tc.wantEvent == "" && len(queued) > 0:
+				t.Errorf("queued %+v, want nothing", queued)
+			case tc.wantEvent != "" && len(queued) != 1:
+				t.Errorf("queued %d jobs, want 1", len(queued))
+			case tc.wantEvent != "" && (queued[0].event != tc.wantEvent || queued[0].effect != tc.wantFx):
+				t.Errorf("queued event %q effect %q, want %q %q", queued[0].event, queued[0].effect, tc.wantEvent, tc.wantFx)
+			}
+		})
+	}
+}
+
+func TestConnectDialsConfiguredURL(t *testing.T) {
+	sandbox(t)
+	if err := os.WriteFile("client.json", []byte(`{"deviceId":"dev-a","deviceSecret":"s3cret"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	type dial struct{ path, device string }
+	dials := make(chan dial, 1)
+	up := websocket.Upgrader{Subprotocols: []string{wsSubprotocol}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case dials <- dial{r.URL.Path, r.Header.Get("X-Device-ID")}:
+		default: // a reconnect; the first dial is the one checked
+		}
+		if c, err := up.Upgrade(w, r, nil); err == nil {
+			defer c.Close()
+			_, _, _ = c.ReadMessage() // the hello
+		}
+	}))
+	t.Cleanup(ts.Close) // after the loop below has stopped
+
+	oldServers, oldDialer := servers, dialer
+	configureEndpoints(clientConfig{WSURL: "ws" + strings.TrimPrefix(ts.URL, "http") + "/from-config/ws"})
+	var dialed atomic.Int32
+	dialer = &websocket.Dialer{
+		Subprotocols: []string{wsSubprotocol},
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		connectToWebSocket(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+		servers, dialer = oldServers, oldDialer
+	})
+
+	select {
+	case d := <-dials:
+		if d.path != "/from-config/ws" || d.device != "dev-a" {
+			t.Errorf("dialed %q as %q, want /from-config/ws as dev-a", d.path, d.device)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connectToWebSocket never dialed the configured URL")
+	}
+	if dialed.Load() == 0 {
+		t.Error("the injected dialer was not used")
+	}
+}
+
+func TestFinishBootConcurrent(t *testing.T) {
+	sandbox(t)
+	var cfg clientConfig
+	cfg.Boot.Effect = "rainbow"
+	startBootEffect(cfg)
+	if !booting() {
+		t.Fatal("no boot effect started")
+	}
+	for deadline := time.Now().Add(time.Second); ledcontrol.CurrentEffect() == "" && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond) // as on a real boot, where prefs take a while
+	}
+	// the read loop, the worker and the frame timer can all get here at once
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			finishBoot()
+			if booting() {
+				t.Error("finishBoot returned with the boot effect still pending")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestOffSurvivesPrefsFetch(t *testing.T) {
+	sandbox(t)
+	withPrefs(t)
+	t.Cleanup(func() { stripOff.Store(false) })
+	if err := ledcontrol.SaveState(ledcontrol.IdleState{Effect: "breath", Color: "#0000FF", Off: true}); err != nil {
+		t.Fatal(err)
+	}
+	serveOnly(t, http.StatusOK, `{"idle":{"effect":"breath","color":"#FF0000"},"events":{}}`)
+
+	// boot: restore, then the startup fetch
+	restoreIdle()
+	if !fetchPrefs("dev-a") {
+		t.Fatal("prefs not applied")
+	}
+	if !stripOff.Load() || ledcontrol.IdleRunning() {
+		t.Fatalf("after the startup fetch: off=%v idle running=%v, want still off", stripOff.Load(), ledcontrol.IdleRunning())
+	}
+	if st, _ := ledcontrol.LoadState(); !st.Off {
+		t.Error("state.json no longer says off")
+	}
+
+	// a config update turns it back on
+	configUpdated("dev-a")
+	if stripOff.Load() || !ledcontrol.IdleRunning() {
+		t.Errorf("after config_updated: off=%v idle running=%v, want on", stripOff.Load(), ledcontrol.IdleRunning())
+	}
+}
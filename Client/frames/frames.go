@@ -0,0 +1,743 @@
+// Package frames is the pure side of the LED effects: color math and
+// generators that produce successive strip buffers without touching
+// hardware. ledcontrol plays them on the strip; the server renders them
+// into previews.
+package frames
+
+import (
+	"iter"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	Red   uint32 = 0xFF0000
+	Green uint32 = 0x00FF00
+	Blue  uint32 = 0x0000FF
+	White uint32 = 0xFFFFFF
+	Off   uint32 = 0x000000
+)
+
+// Seq yields successive frames and how long each should stay on the strip.
+// The slice is reused between frames; copy it if you need to keep it.
+type Seq = iter.Seq2[[]uint32, time.Duration]
+
+//
+// ==========
+//  Color math
+// ==========
+//
+
+// Fade scales 0xRRGGBB by factor [0..1].
+func Fade(col uint32, factor float64) uint32 {
+	if factor <= 0 {
+		return Off
+	}
+	if factor > 1 {
+		factor = 1
+	}
+	r := uint32(float64((col>>16)&0xFF) * factor)
+	g := uint32(float64((col>>8)&0xFF) * factor)
+	b := uint32(float64(col&0xFF) * factor)
+	return (r << 16) | (g << 8) | b
+}
+
+// Wheel maps 0..255 onto the classic r→g→b color wheel.
+func Wheel(pos int) uint32 {
+	pos = 255 - pos
+	switch {
+	case pos < 85:
+		return uint32((255-pos)<<16 | 0<<8 | pos)
+	case pos < 170:
+		pos -= 85
+		return uint32(0<<16 | pos<<8 | (255 - pos))
+	default:
+		pos -= 170
+		return uint32(pos<<16 | (255-pos)<<8)
+	}
+}
+
+// Lerp blends a toward b per channel; t=0 is a, t=1 is b.
+func Lerp(a, b uint32, t float64) uint32 {
+	if t <= 0 {
+		return a
+	}
+	if t >= 1 {
+		return b
+	}
+	ch := func(shift uint) uint32 {
+		x, y := float64((a>>shift)&0xFF), float64((b>>shift)&0xFF)
+		return uint32(x+(y-x)*t+0.5) << shift
+	}
+	return ch(16) | ch(8) | ch(0)
+}
+
+// Gradient picks the color at t (0..1) along evenly spaced stops.
+func Gradient(stops []uint32, t float64) uint32 {
+	switch len(stops) {
+	case 0:
+		return Off
+	case 1:
+		return stops[0]
+	}
+	if t <= 0 {
+		return stops[0]
+	}
+	if t >= 1 {
+		return stops[len(stops)-1]
+	}
+	pos := t * float64(len(stops)-1)
+	i := int(pos)
+	return Lerp(stops[i], stops[i+1], pos-float64(i))
+}
+
+// Fill sets every pixel of buf to color.
+func Fill(buf []uint32, color uint32) {
+	for i := range buf {
+		buf[i] = color
+	}
+}
+
+// WarmWhite approximates the RGB of a black-body light at kelvin, clamped
+// to 2000..6500K (Tanner Helland's curve fit). The strips have no white
+// channel, so this is the closest we get to a warm-white bulb.
+func WarmWhite(kelvin int) uint32 {
+	kelvin = min(max(kelvin, 2000), 6500)
+	t := float64(kelvin) / 100
+	clamp := func(v float64) uint32 {
+		return uint32(math.Max(0, math.Min(255, v)) + 0.5)
+	}
+	// below 6600K red is saturated and only green/blue follow the curve
+	r := uint32(255)
+	g := clamp(99.4708025861*math.Log(t) - 161.1195681661)
+	b := uint32(0)
+	if t > 19 {
+		b = clamp(138.5177312231*math.Log(t-10) - 305.0447927307)
+	}
+	return r<<16 | g<<8 | b
+}
+
+// HSVToRGB converts hue (degrees, any value; wrapped to 0..360) with
+// saturation and value in 0..1 to 0xRRGGBB.
+func HSVToRGB(h, s, v float64) uint32 {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	s, v = math.Max(0, math.Min(s, 1)), math.Max(0, math.Min(v, 1))
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := v - c
+	ch := func(f float64) uint32 { return uint32((f+m)*255 + 0.5) }
+	return ch(r)<<16 | ch(g)<<8 | ch(b)
+}
+
+// Curve shapes how a comet tail fades from its head to its tip.
+type Curve int
+
+const (
+	CurveLinear Curve = iota // straight ramp (the original look)
+	CurveExp                 // hot head, then a long soft glow
+	CurveGamma               // ramp^2.2: closer to how the eye sees brightness
+)
+
+// ParseCurve maps "linear", "exp"/"exponential" and "gamma" to a Curve;
+// "" is linear.
+func ParseCurve(s string) (Curve, bool) {
+	switch s {
+	case "", "linear":
+		return CurveLinear, true
+	case "exp", "exponential":
+		return CurveExp, true
+	case "gamma":
+		return CurveGamma, true
+	}
+	return CurveLinear, false
+}
+
+// FadeCurve is the brightness factor for tail position t (0 = head) of a
+// tail-long comet.
+func FadeCurve(t, tail int, c Curve) float64 {
+	if tail <= 0 {
+		return 1
+	}
+	x := float64(t) / float64(tail)
+	switch c {
+	case CurveExp:
+		return math.Exp(-4 * x)
+	case CurveGamma:
+		return math.Pow(1-x, 2.2)
+	}
+	return 1 - x
+}
+
+// CometPixel is the pixel t steps behind a comet head: color faded along
+// the tail by curve. glow (0..1) overshoots the head toward white for a
+// hotter core — fully at the head, half as much on the pixel behind it;
+// 0 draws the head as a plain pixel.
+func CometPixel(color uint32, t, tail int, curve Curve, glow float64) uint32 {
+	c := Fade(color, FadeCurve(t, tail, curve))
+	glow = math.Min(math.Max(glow, 0), 1)
+	switch {
+	case glow == 0 || t > 1:
+		return c
+	case t == 1:
+		glow /= 2
+	}
+	return Lerp(c, White, glow)
+}
+
+//
+// ==========
+//  Pacing
+// ==========
+//
+
+// One-pass durations the wipe and rainbow were tuned to on a 300-LED strip
+// (5ms/2ms sleeps plus ~9ms of render time per frame).
+const (
+	DefaultWipeDuration    = 4200 * time.Millisecond
+	DefaultRainbowDuration = 8500 * time.Millisecond
+)
+
+// RenderCost estimates one WS2811 render of n LEDs: 24 bits at 800kHz per
+// LED plus the ~50µs latch. Long strips spend most of each frame here.
+func RenderCost(n int) time.Duration {
+	return time.Duration(n)*30*time.Microsecond + 50*time.Microsecond
+}
+
+// Pace spreads steps over total, given each rendered frame already costs
+// cost. It returns the sleep per frame and how many steps to advance per
+// frame (more than one when rendering alone would overrun total).
+func Pace(total time.Duration, steps int, cost time.Duration) (delay time.Duration, per int) {
+	if steps <= 0 {
+		return 0, 1
+	}
+	per = 1
+	if budget := total / time.Duration(steps); budget > cost {
+		return budget - cost, per
+	}
+	if total > 0 {
+		per = int((time.Duration(steps)*cost + total - 1) / total)
+	}
+	if per < 1 {
+		per = 1
+	}
+	nframes := (steps + per - 1) / per
+	delay = total/time.Duration(nframes) - cost
+	return max(delay, 0), per
+}
+
+//
+// ==========
+//  Generators
+// ==========
+//
+
+// Blink flashes the whole strip: 500ms on, 250ms off, per cycle.
+func Blink(n int, color uint32, cycles int) Seq {
+	return Flash(n, color, cycles, 500*time.Millisecond, 250*time.Millisecond)
+}
+
+// Flash shows color for on, then black for off, times times.
+func Flash(n int, color uint32, times int, on, off time.Duration) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		buf := make([]uint32, n)
+		for c := 0; c < times; c++ {
+			Fill(buf, color)
+			if !yield(buf, on) {
+				return
+			}
+			Fill(buf, Off)
+			if !yield(buf, off) {
+				return
+			}
+		}
+	}
+}
+
+// Wipe lights the strip per pixels per frame, holds briefly, then clears.
+func Wipe(n int, color uint32, cycles int, delay time.Duration, per int) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		per = max(per, 1)
+		buf := make([]uint32, n)
+		for c := 0; c < cycles; c++ {
+			for i := 0; i < n; i += per {
+				end := min(i+per, n)
+				for j := i; j < end; j++ {
+					buf[j] = color
+				}
+				hold := delay
+				if end == n {
+					hold += 200 * time.Millisecond
+				}
+				if !yield(buf, hold) {
+					return
+				}
+			}
+			Fill(buf, Off)
+			if !yield(buf, 0) {
+				return
+			}
+		}
+	}
+}
+
+// Converge wipes in from both ends at once, one pixel per side per frame,
+// meeting in the middle (on odd lengths the center pixel lights last, once).
+// With blink it flashes the full strip once when the halves meet. Ends dark.
+func Converge(n int, color uint32, delay time.Duration, blink bool) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		buf := make([]uint32, n)
+		for i := 0; i < (n+1)/2; i++ {
+			buf[i] = color
+			buf[n-1-i] = color
+			if !yield(buf, delay) {
+				return
+			}
+		}
+		if blink && n > 0 {
+			Fill(buf, Off)
+			if !yield(buf, 150*time.Millisecond) {
+				return
+			}
+			Fill(buf, color)
+			if !yield(buf, 300*time.Millisecond) {
+				return
+			}
+		}
+		Fill(buf, Off)
+		yield(buf, 0)
+	}
+}
+
+// Charge fills the strip from LED 0 over d, slowly at first and faster as
+// it goes, brightening from a quarter to full as it fills: the wind-up of
+// a charge-and-burst.
+func Charge(n int, color uint32, d time.Duration) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		const step = 20 * time.Millisecond
+		steps := max(int(d/step), 1)
+		buf := make([]uint32, n)
+		for s := 1; s <= steps; s++ {
+			t := float64(s) / float64(steps)
+			lit := int(math.Ceil(float64(n) * t * t))
+			c := Fade(color, 0.25+0.75*t)
+			for i := range buf {
+				if i < lit {
+					buf[i] = c
+				} else {
+					buf[i] = Off
+				}
+			}
+			if !yield(buf, step) {
+				return
+			}
+		}
+	}
+}
+
+// Countdown starts with all n LEDs lit and puts one out every d/n, from
+// the far end back to LED 0, ending on a dark frame as d runs out: a
+// reverse progress bar. Like Still it re-yields at least every 100ms so a
+// player can stop partway, and it takes RenderCost off each hold so the
+// renders don't stretch the total.
+func Countdown(n int, color uint32, d time.Duration) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		if n <= 0 {
+			return
+		}
+		const step = 100 * time.Millisecond
+		cost := RenderCost(n)
+		buf := make([]uint32, n)
+		Fill(buf, color)
+		for k := 1; k <= n; k++ {
+			// LED n-k goes out at k*d/n; computed from the start, not summed
+			left := d*time.Duration(k)/time.Duration(n) - d*time.Duration(k-1)/time.Duration(n)
+			for ; left > 0; left -= step {
+				if !yield(buf, max(min(step, left)-cost, 0)) {
+					return
+				}
+			}
+			buf[n-k] = Off
+		}
+		yield(buf, 0)
+	}
+}
+
+// RainbowSteps is how many wheel positions one rainbow cycle rotates through.
+const RainbowSteps = 256 * 3
+
+// Rainbow runs the color wheel along the strip and rotates it once per
+// cycle, advancing per wheel positions each frame.
+func Rainbow(n int, cycles int, delay time.Duration, per int) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		if n <= 0 {
+			return
+		}
+		per = max(per, 1)
+		buf := make([]uint32, n)
+		for c := 0; c < cycles; c++ {
+			for j := 0; j < RainbowSteps; j += per {
+				for i := range buf {
+					buf[i] = Wheel((i*256/n + j) & 255)
+				}
+				if !yield(buf, delay) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Comet sends a single head down the strip, then clears. The tail fades
+// along curve (CurveLinear is a straight ramp) and glow (0..1) pushes the
+// head toward white.
+func Comet(n int, color uint32, tail int, delay time.Duration, curve Curve, glow float64) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		if tail < 1 {
+			tail = 1
+		}
+		buf := make([]uint32, n)
+		for step := 0; step < n+tail; step++ {
+			Fill(buf, Off)
+			for t := 0; t < tail; t++ {
+				pos := step - t
+				if pos < 0 || pos >= n {
+					continue
+				}
+				buf[pos] = CometPixel(color, t, tail, curve, glow)
+			}
+			if !yield(buf, delay) {
+				return
+			}
+		}
+		Fill(buf, Off)
+		yield(buf, 0)
+	}
+}
+
+// Bounce runs a comet back and forth; each end counts as half a bounce.
+func Bounce(n int, color uint32, tail int, delay time.Duration, bounces int, curve Curve, glow float64) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		if n <= 0 {
+			return
+		}
+		if tail < 1 {
+			tail = 1
+		}
+		if bounces < 1 {
+			bounces = 1
+		}
+		buf := make([]uint32, n)
+		head := 0
+		dir := 1 // +1 forward, -1 backward
+		b := 0
+		for {
+			Fill(buf, Off)
+			for t := 0; t < tail; t++ {
+				pos := head - t*dir
+				if pos >= 0 && pos < n {
+					buf[pos] = CometPixel(color, t, tail, curve, glow)
+				}
+			}
+			if !yield(buf, delay) {
+				return
+			}
+
+			head += dir
+			if head <= 0 {
+				head = 0
+				dir = +1
+				b++
+			} else if head >= n-1 {
+				head = n - 1
+				dir = -1
+				b++
+			}
+			if b >= bounces*2 {
+				break
+			}
+		}
+		Fill(buf, Off)
+		yield(buf, 0)
+	}
+}
+
+// StackedShoot fills the strip from the END backwards with repeated comet
+// passes, rotating through colors: each time the leading comet reaches the
+// filled part it commits a tail-length chunk, and a new comet is spawned
+// once the last one is halfway through the unfilled window. When full, it
+// blinks the committed segments blinks times and clears.
+func StackedShoot(n int, colors []uint32, tail int, delay time.Duration, blinks int, curve Curve, glow float64) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		if n <= 0 || len(colors) == 0 {
+			return
+		}
+		// A chunk never exceeds the strip, so tail > n behaves like tail == n
+		// (n == 1 just commits one pixel per pass).
+		tail = min(max(tail, 1), n)
+
+		// Filled (persist) lives at the END of the strip.
+		persist := make([]uint32, n)
+		filledStart := n // unfilled window is [0..filledStart-1]
+		colorIdx := 0
+
+		type shot struct {
+			head  int
+			color uint32
+		}
+		var shots []shot
+
+		// Clean slate so we don't "flash" at the beginning.
+		buf := make([]uint32, n)
+		if !yield(buf, 0) {
+			return
+		}
+
+		// Seed first shot.
+		shots = append(shots, shot{head: 0, color: colors[colorIdx%len(colors)]})
+		colorIdx++
+
+		for filledStart > 0 {
+			// Base = persist (already committed segments at the end),
+			// then overlay all active shots into the unfilled window.
+			copy(buf, persist)
+			for _, s := range shots {
+				for t := 0; t < tail; t++ {
+					pos := s.head - t
+					if pos < 0 || pos >= filledStart {
+						continue
+					}
+					buf[pos] = CometPixel(s.color, t, tail, curve, glow)
+				}
+			}
+			if !yield(buf, delay) {
+				return
+			}
+
+			for i := range shots {
+				shots[i].head++
+			}
+
+			// If the leading shot reached the boundary, commit a chunk of 'tail' to the end.
+			// Invariant: 0 < chunk <= filledStart <= n, so the writes below
+			// stay inside persist[0:filledStart].
+			if len(shots) > 0 && shots[0].head >= filledStart {
+				chunk := min(tail, filledStart)
+				for i := 0; i < chunk; i++ {
+					persist[filledStart-1-i] = shots[0].color
+				}
+				filledStart -= chunk
+				shots = shots[1:]
+			}
+
+			// Spawn the next shot when the LAST active shot is halfway through the unfilled window.
+			if filledStart > 0 {
+				half := filledStart / 2
+				if len(shots) == 0 || shots[len(shots)-1].head >= half {
+					shots = append(shots, shot{head: 0, color: colors[colorIdx%len(colors)]})
+					colorIdx++
+				}
+			}
+		}
+
+		// Final: blink using the ACTUAL segment colors (not white)
+		for b := 0; b < blinks; b++ {
+			copy(buf, persist)
+			if !yield(buf, 220*time.Millisecond) {
+				return
+			}
+			Fill(buf, Off)
+			if !yield(buf, 220*time.Millisecond) {
+				return
+			}
+		}
+		Fill(buf, Off)
+		yield(buf, 0)
+	}
+}
+
+// Celebrate shows each color on the whole strip for a second, then clears.
+func Celebrate(n int, colors []uint32) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		buf := make([]uint32, n)
+		for _, c := range colors {
+			Fill(buf, c)
+			if !yield(buf, time.Second) {
+				return
+			}
+		}
+		Fill(buf, Off)
+		yield(buf, 0)
+	}
+}
+
+// ByName returns the generator for a named effect with the same timings
+// ledcontrol uses on the strip. ok is false for names it doesn't know.
+func ByName(effect string, color uint32, cycles int, n int) (seq Seq, ok bool) {
+	if cycles <= 0 {
+		cycles = 1
+		if effect == "blink" {
+			cycles = 3
+		}
+	}
+	switch effect {
+	case "blink":
+		return Blink(n, color, cycles), true
+	case "wipe":
+		delay, per := Pace(DefaultWipeDuration, n, RenderCost(n))
+		return Wipe(n, color, cycles, delay, per), true
+	case "rainbow":
+		delay, per := Pace(DefaultRainbowDuration, RainbowSteps, RenderCost(n))
+		return Rainbow(n, cycles, delay, per), true
+	case "converge":
+		return repeat(cycles, Converge(n, color, 10*time.Millisecond, true)), true
+	case "shoot":
+		return Comet(n, Blue, 8, 20*time.Millisecond, CurveLinear, 0), true
+	case "shoot_bounce":
+		return Bounce(n, Blue, 8, 15*time.Millisecond, 4, CurveLinear, 0), true
+	case "stacked_shooting", "deal_won_stacked":
+		return StackedShoot(n, []uint32{Red, Blue, Green}, 8, 15*time.Millisecond, 3, CurveLinear, 0), true
+	case "celebrate_legacy":
+		return Celebrate(n, []uint32{Red, Blue, Green}), true
+	}
+	return nil, false
+}
+
+// repeat plays seq times times back to back.
+func repeat(times int, seq Seq) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		for i := 0; i < times; i++ {
+			for buf, hold := range seq {
+				if !yield(buf, hold) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Mirror lays half across an n-LED strip and reflects it, so every index
+// i >= n/2 shows n-1-i and the two halves meet in the middle. It writes
+// into dst (reused when large enough) and returns it.
+func Mirror(dst, half []uint32, n int) []uint32 {
+	dst = slices.Grow(dst[:0], n)[:n]
+	clear(dst)
+	copy(dst, half)
+	for i := n / 2; i < n; i++ {
+		dst[i] = dst[n-1-i]
+	}
+	return dst
+}
+
+// TestPattern is the commissioning frame: LED 0 red, 1 green, 2 blue (a
+// swapped pair means the color order is wrong), every 10th LED white to
+// count by, and the last LED yellow (dark means LedCount is too high).
+func TestPattern(n int) []uint32 {
+	buf := make([]uint32, n)
+	for i := 10; i < n; i += 10 {
+		buf[i] = White
+	}
+	for i, c := range []uint32{Red, Green, Blue} {
+		if i < n {
+			buf[i] = c
+		}
+	}
+	if n > 0 {
+		buf[n-1] = 0xFFFF00
+	}
+	return buf
+}
+
+// Still holds frame for d, re-yielding it every 100ms so a player can
+// stop partway.
+func Still(frame []uint32, d time.Duration) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		const step = 100 * time.Millisecond
+		for left := d; left > 0; left -= step {
+			if !yield(frame, min(step, left)) {
+				return
+			}
+		}
+	}
+}
+
+// GradientFill spreads a linear from→to gradient along buf.
+func GradientFill(buf []uint32, from, to uint32) {
+	for i := range buf {
+		t := 0.0
+		if len(buf) > 1 {
+			t = float64(i) / float64(len(buf)-1)
+		}
+		buf[i] = Lerp(from, to, t)
+	}
+}
+
+// Sparkle lays short white sparkles over a fixed background. Each Step
+// every sparkle fades by Decay and each dark pixel lights with chance
+// Chance, so it runs forever; the caller supplies the randomness.
+type Sparkle struct {
+	Background []uint32
+	Chance     float64 // per pixel per step
+	Decay      float64 // brightness lost per step, 0..1
+	level      []float64
+}
+
+// Step advances the sparkles one frame and draws them into dst (resized
+// to the background).
+func (s *Sparkle) Step(dst []uint32, rnd func() float64) []uint32 {
+	n := len(s.Background)
+	if len(s.level) != n {
+		s.level = make([]float64, n)
+	}
+	dst = slices.Grow(dst[:0], n)[:n]
+	for i, bg := range s.Background {
+		if s.level[i] > 0 {
+			s.level[i] = math.Max(0, s.level[i]-s.Decay)
+		} else if rnd() < s.Chance {
+			s.level[i] = 1
+		}
+		dst[i] = Lerp(bg, White, s.level[i])
+	}
+	return dst
+}
+
+// Segments draws count as blocks on an n-LED strip: from LED 0, each unit
+// is block lit LEDs followed by gap dark ones. Units past the end of the
+// strip are dropped; MaxSegments says how many fit.
+func Segments(n, count, block, gap int, color uint32) []uint32 {
+	buf := make([]uint32, n)
+	for u := 0; u < count; u++ {
+		start := u * (block + gap)
+		for i := start; i < start+block && i < n; i++ {
+			buf[i] = color
+		}
+	}
+	return buf
+}
+
+// MaxSegments is how many whole blocks Segments fits on an n-LED strip
+// (the last block needs no trailing gap).
+func MaxSegments(n, block, gap int) int {
+	if block <= 0 || n < block {
+		return 0
+	}
+	return (n + gap) / (block + gap)
+}
@@ -0,0 +1,87 @@
+package frames
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStackedShootFillsStrip(t *testing.T) {
+	colors := []uint32{Red, Blue}
+	cases := []struct {
+		name    string
+		n, tail int
+	}{
+		{"single LED", 1, 3},
+		{"two LEDs", 2, 1},
+		{"three LEDs", 3, 2},
+		{"odd", 7, 3},
+		{"even", 8, 2},
+		{"tail longer than strip", 5, 9},
+		{"zero tail", 6, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// one blink: the full strip, then off, then the closing clear
+			var got [][]uint32
+			for buf := range StackedShoot(tc.n, colors, tc.tail, time.Millisecond, 1, CurveLinear, 0) {
+				got = append(got, slices.Clone(buf))
+				if len(got) > 100000 {
+					t.Fatal("sequence never ends")
+				}
+			}
+			if len(got) < 3 {
+				t.Fatalf("got %d frames, want at least 3", len(got))
+			}
+			full := got[len(got)-3]
+
+			// chunks of tail are committed from the end, alternating colors
+			chunk := min(max(tc.tail, 1), tc.n)
+			for i, c := range full {
+				want := colors[(tc.n-1-i)/chunk%len(colors)]
+				if c != want {
+					t.Errorf("LED %d = #%06X, want #%06X (frame %06X)", i, c, want, full)
+				}
+			}
+			if last := got[len(got)-1]; slices.ContainsFunc(last, func(c uint32) bool { return c != Off }) {
+				t.Errorf("strip not cleared at the end: %06X", last)
+			}
+		})
+	}
+}
+
+func TestWarmWhite(t *testing.T) {
+	// reference black-body RGB (Mitchell Charity's table); the curve fit
+	// is allowed to be a few steps off per channel
+	const tolerance = 6
+	cases := []struct {
+		kelvin  int
+		r, g, b int
+	}{
+		{1900, 255, 137, 18}, // clamped to 2000K
+		{2000, 255, 137, 18},
+		{2700, 255, 169, 87},
+		{6500, 255, 249, 253},
+		{10000, 255, 249, 253}, // clamped to 6500K
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.kelvin, "K"), func(t *testing.T) {
+			c := WarmWhite(tc.kelvin)
+			r, g, b := int(c>>16&0xFF), int(c>>8&0xFF), int(c&0xFF)
+			if abs(r-tc.r) > tolerance || abs(g-tc.g) > tolerance || abs(b-tc.b) > tolerance {
+				t.Errorf("WarmWhite(%d) = %d,%d,%d, want about %d,%d,%d", tc.kelvin, r, g, b, tc.r, tc.g, tc.b)
+			}
+		})
+	}
+	if WarmWhite(1000) != WarmWhite(2000) || WarmWhite(20000) != WarmWhite(6500) {
+		t.Error("out-of-range temperatures are not clamped to 2000..6500K")
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,155 @@
+package frames
+
+import (
+	"strings"
+	"time"
+)
+
+//
+// ==========
+//  2D Matrix
+// ==========
+//
+
+// Matrix maps (x, y) on a W×H panel onto strip indices. Rows run left to
+// right from the first LED; Serpentine panels (the usual wiring) reverse
+// every other row.
+type Matrix struct {
+	W, H       int
+	Serpentine bool
+}
+
+// Index returns the strip index of (x, y), or -1 when it's off the panel.
+func (m Matrix) Index(x, y int) int {
+	if x < 0 || y < 0 || x >= m.W || y >= m.H {
+		return -1
+	}
+	if m.Serpentine && y%2 == 1 {
+		x = m.W - 1 - x
+	}
+	return y*m.W + x
+}
+
+// Set colors (x, y) in buf; points off the panel or past buf are ignored.
+func (m Matrix) Set(buf []uint32, x, y int, color uint32) {
+	if i := m.Index(x, y); i >= 0 && i < len(buf) {
+		buf[i] = color
+	}
+}
+
+//
+// ==========
+//  5x7 Font
+// ==========
+//
+
+// font5x7 holds ' '..'Z' as five columns each, bit 0 = top row.
+// Lowercase is drawn as uppercase; anything else as '?'.
+var font5x7 = [...][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // ' '
+	{0x00, 0x00, 0x5F, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7F, 0x14, 0x7F, 0x14}, // #
+	{0x24, 0x2A, 0x7F, 0x2A, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x56, 0x20, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1C, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1C, 0x00}, // )
+	{0x2A, 0x1C, 0x7F, 0x1C, 0x2A}, // *
+	{0x08, 0x08, 0x3E, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3E, 0x51, 0x49, 0x45, 0x3E}, // 0
+	{0x00, 0x42, 0x7F, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4B, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7F, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3C, 0x4A, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1E}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3E}, // @
+	{0x7E, 0x11, 0x11, 0x11, 0x7E}, // A
+	{0x7F, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3E, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7F, 0x41, 0x41, 0x22, 0x1C}, // D
+	{0x7F, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7F, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3E, 0x41, 0x49, 0x49, 0x7A}, // G
+	{0x7F, 0x08, 0x08, 0x08, 0x7F}, // H
+	{0x00, 0x41, 0x7F, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3F, 0x01}, // J
+	{0x7F, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7F, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7F, 0x02, 0x0C, 0x02, 0x7F}, // M
+	{0x7F, 0x04, 0x08, 0x10, 0x7F}, // N
+	{0x3E, 0x41, 0x41, 0x41, 0x3E}, // O
+	{0x7F, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3E, 0x41, 0x51, 0x21, 0x5E}, // Q
+	{0x7F, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7F, 0x01, 0x01}, // T
+	{0x3F, 0x40, 0x40, 0x40, 0x3F}, // U
+	{0x1F, 0x20, 0x40, 0x20, 0x1F}, // V
+	{0x3F, 0x40, 0x38, 0x40, 0x3F}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+}
+
+// textColumns lays msg out as font columns with one blank column between
+// characters.
+func textColumns(msg string) []byte {
+	msg = strings.ToUpper(msg)
+	msg = strings.NewReplacer("—", "-", "–", "-").Replace(msg)
+	var cols []byte
+	for _, r := range msg {
+		if r < ' ' || r > 'Z' {
+			r = '?'
+		}
+		cols = append(cols, font5x7[r-' '][:]...)
+		cols = append(cols, 0)
+	}
+	return cols
+}
+
+// ScrollText scrolls msg right to left across m, one column per frame held
+// for speed, vertically centered. passes <= 0 loops until the consumer
+// stops pulling frames.
+func ScrollText(m Matrix, msg string, color uint32, speed time.Duration, passes int) Seq {
+	return func(yield func([]uint32, time.Duration) bool) {
+		cols := textColumns(msg)
+		buf := make([]uint32, m.W*m.H)
+		top := (m.H - 7) / 2
+		for pass := 0; passes <= 0 || pass < passes; pass++ {
+			// start fully off the right edge, end fully off the left
+			for off := -m.W; off <= len(cols); off++ {
+				Fill(buf, Off)
+				for x := 0; x < m.W; x++ {
+					c := off + x
+					if c < 0 || c >= len(cols) {
+						continue
+					}
+					for row := 0; row < 7; row++ {
+						if cols[c]&(1<<row) != 0 {
+							m.Set(buf, x, top+row, color)
+						}
+					}
+				}
+				if !yield(buf, speed) {
+					return
+				}
+			}
+		}
+	}
+}
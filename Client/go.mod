@@ -3,6 +3,7 @@ module celebration
 go 1.24.0
 
 require (
+	github.com/gen2brain/malgo v0.11.24
 	github.com/gorilla/websocket v1.5.3
 	github.com/rpi-ws281x/rpi-ws281x-go v1.0.10
 )
@@ -0,0 +1,186 @@
+package ledcontrol
+
+// Stacking dots: a "deals closed today" bar. Every StackOne adds one dot
+// after the last, from LED 0 up, and the dots stay lit over whatever else
+// plays (drawn in applyReserved, under the reserved accents). The bar is
+// kept in stackFile so a restart doesn't lose the day's count, and it is
+// cleared at config stackResetAt ("HH:MM" local time, default midnight).
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const stackFile = "stack.json"
+
+// stackState is stackFile's shape.
+type stackState struct {
+	Colors []string  `json:"colors"` // "#RRGGBB", from LED 0 up
+	Since  time.Time `json:"since"`  // when this bar was started
+}
+
+var (
+	stack       []uint32  // guarded by ledMutex
+	stackSince  time.Time // guarded by ledMutex
+	stackLoaded bool      // guarded by ledMutex
+	stackWatch  sync.Once
+)
+
+// parseClock reads "HH:MM" (24h) as hours and minutes.
+func parseClock(s string) (h, m int, err error) {
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, 0, fmt.Errorf("stackResetAt %q: want HH:MM", s)
+	}
+	return h, m, nil
+}
+
+// lastStackReset is the most recent stackResetAt at or before now.
+func lastStackReset(now time.Time) time.Time {
+	h, m, _ := parseClock(config.StackResetAt) // validated on load; "" is midnight
+	at := time.Date(now.Year(), now.Month(), now.Day(), h, m, 0, 0, now.Location())
+	if at.After(now) {
+		at = at.AddDate(0, 0, -1)
+	}
+	return at
+}
+
+// loadStack reads stackFile once and starts the reset watcher. Callers
+// hold ledMutex.
+func loadStack() {
+	if stackLoaded {
+		return
+	}
+	stackLoaded = true
+	stackWatch.Do(func() { SafeGo("stack reset", watchStackReset) })
+	b, err := os.ReadFile(stackFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("stack: %v", err)
+		}
+		return
+	}
+	var st stackState
+	if err := json.Unmarshal(b, &st); err != nil {
+		log.Printf("stack: corrupt %s: %v; starting empty", stackFile, err)
+		return
+	}
+	stack, stackSince = stack[:0], st.Since
+	for _, c := range st.Colors {
+		stack = append(stack, parseHexColor(c))
+	}
+	if !resetStaleStack(time.Now()) && len(stack) > 0 {
+		log.Printf("stack: restored %d dot(s) since %s", len(stack), stackSince.Format(time.RFC3339))
+	}
+}
+
+// saveStack writes the bar atomically. Callers hold ledMutex.
+func saveStack() {
+	st := stackState{Since: stackSince}
+	for _, c := range stack {
+		st.Colors = append(st.Colors, fmt.Sprintf("#%06X", c))
+	}
+	b, _ := json.Marshal(st)
+	tmp := stackFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		log.Printf("stack: save: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, stackFile); err != nil {
+		log.Printf("stack: save: %v", err)
+	}
+}
+
+// resetStaleStack clears a bar started before the last reset time and
+// reports whether it did. Callers hold ledMutex.
+func resetStaleStack(now time.Time) bool {
+	if len(stack) == 0 || !stackSince.Before(lastStackReset(now)) {
+		return false
+	}
+	log.Printf("stack: daily reset (%d dot(s) cleared)", len(stack))
+	stack, stackSince = stack[:0], now
+	saveStack()
+	return true
+}
+
+// watchStackReset clears the bar on time even when no event comes in.
+func watchStackReset() {
+	for range time.Tick(time.Minute) {
+		ledMutex.Lock()
+		if resetStaleStack(time.Now()) && dev != nil {
+			_ = render()
+		}
+		ledMutex.Unlock()
+	}
+}
+
+// StackOne adds a dot in color (0 = green) to the bar and blinks it in. A
+// full strip keeps its dots and only logs.
+func StackOne(color uint32) {
+	if err := EnsureInit(); err != nil {
+		log.Printf("StackOne: init failed: %v", err)
+		return
+	}
+	if color == 0 {
+		color = colorGreen
+	}
+	ledMutex.Lock()
+	if dev == nil { // shut down or re-initializing since EnsureInit
+		ledMutex.Unlock()
+		log.Printf("StackOne: strip gone; dot not added")
+		return
+	}
+	now := time.Now()
+	resetStaleStack(now)
+	if len(stack) >= len(dev.Leds(0)) {
+		ledMutex.Unlock()
+		log.Printf("StackOne: strip full (%d dots)", len(stack))
+		return
+	}
+	if len(stack) == 0 {
+		stackSince = now
+	}
+	stack = append(stack, color)
+	saveStack()
+	n := len(stack)
+	ledMutex.Unlock()
+	log.Printf("StackOne: dot %d #%06X", n, color)
+
+	for i := range 6 {
+		ledMutex.Lock()
+		if dev == nil || len(stack) < n {
+			ledMutex.Unlock()
+			return
+		}
+		stack[n-1] = color
+		if i%2 == 0 {
+			stack[n-1] = colorOff
+		}
+		_ = render()
+		ledMutex.Unlock()
+		time.Sleep(150 * time.Millisecond)
+	}
+}
+
+// ResetStack clears the bar now.
+func ResetStack() {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	loadStack()
+	log.Printf("stack: reset (%d dot(s) cleared)", len(stack))
+	stack, stackSince = stack[:0], time.Now()
+	saveStack()
+	if dev != nil {
+		_ = render()
+	}
+}
+
+// StackLen is how many dots the bar has.
+func StackLen() int {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	return len(stack)
+}
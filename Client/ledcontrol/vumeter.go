@@ -0,0 +1,143 @@
+//go:build audio
+
+package ledcontrol
+
+// VU meter ("party mode"). Capture goes through malgo (miniaudio, cgo), so
+// this file is only built with the audio tag:
+//
+//	go build -tags audio .
+//
+// Audio is captured from the default input as mono signed 16-bit PCM at
+// vuSampleRate. Every frame the loudest RMS seen since the previous frame
+// becomes the new level; the displayed level jumps up instantly and falls
+// by vuRelease per frame so the bar doesn't flicker. The peak marker holds
+// for vuPeakHold frames, then drops one LED per frame.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"celebration/frames"
+
+	"github.com/gen2brain/malgo"
+)
+
+const (
+	vuSampleRate = 44100 // Hz, mono S16
+	vuGain       = 4.0   // RMS (0..1) × gain = bar fraction; about -12 dBFS fills the strip
+	vuRelease    = 0.85  // per-frame decay of the displayed level
+	vuPeakHold   = 30    // frames the peak marker stays put
+	vuPeakColor  = 0xFFFFFF
+)
+
+// VUMeter lights the strip from index 0 in proportion to microphone
+// loudness, colored along palette (nil = green→yellow→red), with a
+// decaying peak marker. Like the breathing idle it runs until StopIdle.
+func VUMeter(palette []uint32, frameDelay time.Duration) {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		log.Printf("VUMeter: init failed: %v", err)
+		return
+	}
+	if len(palette) < 2 {
+		palette = []uint32{0x00FF00, 0xFFFF00, 0xFF0000}
+	}
+	if frameDelay <= 0 {
+		frameDelay = 20 * time.Millisecond
+	}
+
+	startIdle("VUMeter", func(stop <-chan struct{}) {
+		// the mic is opened here rather than before startIdle so a restart
+		// after a panic gets fresh handles, not the ones the defer freed
+		var peakRMS atomic.Uint64 // loudest RMS since the last frame, as float64 bits
+		closeMic, err := openMic(func(in []byte) {
+			n := len(in) / 2
+			if n == 0 {
+				return
+			}
+			var sum float64
+			for i := 0; i < n; i++ {
+				v := float64(int16(binary.LittleEndian.Uint16(in[2*i:]))) / 32768
+				sum += v * v
+			}
+			rms := math.Sqrt(sum / float64(n))
+			for {
+				old := peakRMS.Load()
+				if rms <= math.Float64frombits(old) || peakRMS.CompareAndSwap(old, math.Float64bits(rms)) {
+					return
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("VUMeter: %v", err)
+			return
+		}
+		defer closeMic()
+
+		n := ledCount()
+		buf := make([]uint32, n)
+		level := 0.0
+		peak, hold := 0, 0
+		idleTicker(stop, frameDelay, func(time.Time) {
+			rms := math.Float64frombits(peakRMS.Swap(0))
+			level = max(math.Min(rms*vuGain, 1), level*vuRelease)
+			lit := int(level*float64(n) + 0.5)
+
+			switch {
+			case lit >= peak:
+				peak, hold = lit, vuPeakHold
+			case hold > 0:
+				hold--
+			case peak > 0:
+				peak--
+			}
+
+			for i := range buf {
+				buf[i] = colorOff
+				if i < lit {
+					buf[i] = frames.Gradient(palette, float64(i)/float64(max(n-1, 1)))
+				}
+			}
+			if peak > 0 && peak <= n {
+				buf[peak-1] = vuPeakColor
+			}
+			renderFrame(buf)
+		})
+	})
+}
+
+// openMic starts mono 16-bit capture at vuSampleRate, handing each buffer
+// to onData; closeMic stops it and frees the audio context.
+func openMic(onData func(in []byte)) (closeMic func(), err error) {
+	actx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("audio context: %w", err)
+	}
+	cfg := malgo.DefaultDeviceConfig(malgo.Capture)
+	cfg.Capture.Format = malgo.FormatS16
+	cfg.Capture.Channels = 1
+	cfg.SampleRate = vuSampleRate
+	mic, err := malgo.InitDevice(actx.Context, cfg, malgo.DeviceCallbacks{
+		Data: func(_, in []byte, _ uint32) { onData(in) },
+	})
+	if err == nil {
+		err = mic.Start()
+	}
+	if err != nil {
+		if mic != nil {
+			mic.Uninit()
+		}
+		_ = actx.Uninit()
+		actx.Free()
+		return nil, fmt.Errorf("capture device: %w", err)
+	}
+	return func() {
+		mic.Uninit()
+		_ = actx.Uninit()
+		actx.Free()
+	}, nil
+}
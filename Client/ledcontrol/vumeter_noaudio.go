@@ -0,0 +1,14 @@
+//go:build !audio
+
+package ledcontrol
+
+import (
+	"log"
+	"time"
+)
+
+// VUMeter needs the audio build tag (see vumeter.go); without it the call
+// only logs why nothing happens.
+func VUMeter(palette []uint32, frameDelay time.Duration) {
+	log.Println("VUMeter: client built without -tags audio; no microphone support")
+}
@@ -1,16 +1,25 @@
 package ledcontrol
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"math/rand/v2"
 	"os"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"celebration/frames"
+
 	ws2811 "github.com/rpi-ws281x/rpi-ws281x-go"
 )
 
@@ -28,7 +37,8 @@ const (
 )
 
 type idleCfg struct {
-	Color string `json:"color"` // "#RRGGBB" breathing color
+	Color  string `json:"color"`  // "#RRGGBB" breathing color
+	ColorB string `json:"colorB"` // "#RRGGBB" second color for breath2
 }
 
 type Config struct {
@@ -36,15 +46,181 @@ type Config struct {
 	LedCount   int     `json:"ledCount"`
 	Brightness int     `json:"brightness"` // 0..255 (driver scales)
 	Idle       idleCfg `json:"idle"`
+
+	// Total time for one wipe pass / one rainbow cycle, whatever the strip
+	// length; per-frame delays are derived from LedCount. 0 = defaults.
+	WipeDurationMs    int `json:"wipeDurationMs"`
+	RainbowDurationMs int `json:"rainbowDurationMs"`
+
+	// Limits on what one event may ask for (0 = defaults: 20 cycles, 60s).
+	MaxCycles        int `json:"maxCycles"`
+	MaxEffectSeconds int `json:"maxEffectSeconds"`
+
+	// Hardware init retries (cold-boot race with the DMA device): up to
+	// InitRetries more attempts, waiting InitRetryMs and doubling each time.
+	InitRetries int `json:"initRetries"`
+	InitRetryMs int `json:"initRetryMs"`
+
+	// Fades to black instead of snapping off: FadeOutMs at the end of each
+	// effect (0 = snap), ShutdownFadeMs when the client exits (default 1s).
+	FadeOutMs      int `json:"fadeOutMs"`
+	ShutdownFadeMs int `json:"shutdownFadeMs"`
+
+	// The "nudge" effect: fade toward the event color over NudgeFadeMs
+	// (default 1s), hold NudgeDwellMs (default 3s; an event's durationMs
+	// wins), fade back.
+	NudgeFadeMs  int `json:"nudgeFadeMs"`
+	NudgeDwellMs int `json:"nudgeDwellMs"`
+
+	// What an unknown effect name plays: "celebrate" (default, the palette
+	// blink), "dim_flash" (one faint flash) or "none". It is logged either way.
+	UnknownEffect string `json:"unknownEffect"`
+
+	// Swap the built-in red/green for orange/sky blue (see SetAccessiblePalette).
+	AccessiblePalette bool `json:"accessiblePalette"`
+
+	// Byte order the strip expects ("RGB", "GRB", "BRG", ...); "" keeps
+	// the driver's WS2812 default, GRB. Colors stay 0xRRGGBB everywhere
+	// else; the driver reorders them on the way out.
+	ColorOrder string `json:"colorOrder,omitempty"`
+
+	// Cap on strip refreshes per second across everything that renders
+	// (effects, idles, raw frames); faster renders wait their turn.
+	MaxFPS int `json:"maxFps"`
+
+	// Accent pixels held at a fixed color whatever is playing (power
+	// indicators and the like): written over every frame just before it
+	// goes out. Effects still draw across these indices, they just never
+	// show there; size effects around them if that matters.
+	Reserved []reservedCfg `json:"reserved,omitempty"`
+
+	// Local "HH:MM" at which the stacking-dots bar (StackOne) is cleared
+	// each day; "" = midnight.
+	StackResetAt string `json:"stackResetAt,omitempty"`
+
+	// Optional 2D panel geometry; nil for a plain strip.
+	Matrix *matrixCfg `json:"matrix,omitempty"`
+}
+
+type reservedCfg struct {
+	Index int    `json:"index"`
+	Color string `json:"color"` // "#RRGGBB"
+}
+
+type matrixCfg struct {
+	Width      int  `json:"width"`
+	Height     int  `json:"height"`
+	Serpentine bool `json:"serpentine"` // every other row runs backwards
+}
+
+func (c Config) wipeDuration() time.Duration {
+	if c.WipeDurationMs > 0 {
+		return time.Duration(c.WipeDurationMs) * time.Millisecond
+	}
+	return frames.DefaultWipeDuration
+}
+
+func (c Config) rainbowDuration() time.Duration {
+	if c.RainbowDurationMs > 0 {
+		return time.Duration(c.RainbowDurationMs) * time.Millisecond
+	}
+	return frames.DefaultRainbowDuration
+}
+
+// strip is the part of the ws2811 driver the effects use, so a simulated
+// strip can stand in when there is no hardware.
+type strip interface {
+	Init() error
+	Render() error
+	Leds(channel int) []uint32
+	SetBrightness(channel int, brightness int)
+	Fini()
 }
 
 var (
-	dev      *ws2811.WS2811
-	config   = Config{LedPin: 18, LedCount: 300, Brightness: 255}
-	ledMutex sync.Mutex
+	dev       strip
+	config    = Config{LedPin: 18, LedCount: 300, Brightness: 255, MaxCycles: 20, MaxEffectSeconds: 60, InitRetries: 5, InitRetryMs: 500, MaxFPS: 100, ShutdownFadeMs: 1000, NudgeFadeMs: 1000, NudgeDwellMs: 3000, UnknownEffect: unknownCelebrate}
+	ledMutex  sync.Mutex
+	simulated bool
+	// brightnessOverride (>= 0) replaces config.Brightness until ResetBrightness.
+	brightnessOverride = -1
 )
 
+// SetSimulated switches InitLEDs to a logging strip that never touches GPIO.
+// Call it before the first effect runs.
+func SetSimulated(on bool) {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	simulated = on
+}
+
+// simStrip keeps the frame in memory and logs a summary at most once a second.
+type simStrip struct {
+	leds     []uint32
+	frames   int
+	lastLog  time.Time
+	lastDesc string
+}
+
+func (s *simStrip) Init() error                       { return nil }
+func (s *simStrip) Leds(channel int) []uint32         { return s.leds }
+func (s *simStrip) SetBrightness(channel, bright int) { log.Printf("sim: brightness %d", bright) }
+func (s *simStrip) Fini()                             {}
+
+func (s *simStrip) Render() error {
+	s.frames++
+	lit := 0
+	var first uint32
+	for _, c := range s.leds {
+		if c != colorOff {
+			if lit == 0 {
+				first = c
+			}
+			lit++
+		}
+	}
+	desc := fmt.Sprintf("%d/%d lit, first #%06X", lit, len(s.leds), first)
+	if desc != s.lastDesc && time.Since(s.lastLog) >= time.Second {
+		log.Printf("sim: frame %d: %s", s.frames, desc)
+		s.lastLog, s.lastDesc = time.Now(), desc
+	}
+	return nil
+}
+
+// LoadConfig reads config.json, then lets LED_PIN, LED_COUNT and
+// LED_BRIGHTNESS from the environment override it (for containers where
+// mounting a file is a chore). Missing both, the defaults stand.
 func LoadConfig() error {
+	err := loadConfigFile()
+	configFromEnv()
+	return err
+}
+
+func configFromEnv() {
+	for _, e := range []struct {
+		name string
+		dst  *int
+		min  int
+		max  int
+	}{
+		{"LED_PIN", &config.LedPin, 0, 64},
+		{"LED_COUNT", &config.LedCount, 1, 1 << 16},
+		{"LED_BRIGHTNESS", &config.Brightness, 0, 255},
+	} {
+		v := strings.TrimSpace(os.Getenv(e.name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < e.min || n > e.max {
+			log.Printf("ignoring %s=%q (want %d..%d)", e.name, v, e.min, e.max)
+			continue
+		}
+		*e.dst = n
+	}
+}
+
+func loadConfigFile() error {
 	f, err := os.Open("config.json")
 	if err != nil {
 		log.Println("config.json not found; using hardware defaults.")
@@ -65,35 +241,402 @@ func LoadConfig() error {
 	if tmp.Brightness != 0 {
 		config.Brightness = tmp.Brightness
 	}
+	if tmp.MaxCycles > 0 {
+		config.MaxCycles = tmp.MaxCycles
+	}
+	if tmp.MaxEffectSeconds > 0 {
+		config.MaxEffectSeconds = tmp.MaxEffectSeconds
+	}
+	if tmp.InitRetries > 0 {
+		config.InitRetries = tmp.InitRetries
+	}
+	if tmp.InitRetryMs > 0 {
+		config.InitRetryMs = tmp.InitRetryMs
+	}
+	if tmp.MaxFPS > 0 {
+		config.MaxFPS = tmp.MaxFPS
+	}
+	if tmp.FadeOutMs >= 0 {
+		config.FadeOutMs = tmp.FadeOutMs
+	}
+	if tmp.ShutdownFadeMs > 0 {
+		config.ShutdownFadeMs = tmp.ShutdownFadeMs
+	}
+	if tmp.NudgeFadeMs > 0 {
+		config.NudgeFadeMs = tmp.NudgeFadeMs
+	}
+	if tmp.NudgeDwellMs > 0 {
+		config.NudgeDwellMs = tmp.NudgeDwellMs
+	}
+	switch u := strings.ToLower(strings.TrimSpace(tmp.UnknownEffect)); u {
+	case "":
+	case unknownCelebrate, unknownDimFlash, unknownNone:
+		config.UnknownEffect = u
+	default:
+		log.Printf("config: unknownEffect %q not recognized; using %s", u, unknownCelebrate)
+	}
+	if tmp.WipeDurationMs > 0 {
+		config.WipeDurationMs = tmp.WipeDurationMs
+	}
+	if tmp.RainbowDurationMs > 0 {
+		config.RainbowDurationMs = tmp.RainbowDurationMs
+	}
+	config.AccessiblePalette = tmp.AccessiblePalette
+	reserved = reserved[:0]
+	for _, r := range tmp.Reserved {
+		if r.Index < 0 {
+			return fmt.Errorf("reserved: index %d must be >= 0", r.Index)
+		}
+		reserved = append(reserved, reservedPixel{r.Index, parseHexColor(r.Color)})
+	}
+	config.Reserved = tmp.Reserved
+	if _, _, err := parseClock(tmp.StackResetAt); tmp.StackResetAt != "" && err != nil {
+		log.Printf("config: %v; resetting the stack at midnight", err)
+		tmp.StackResetAt = ""
+	}
+	config.StackResetAt = tmp.StackResetAt
+	if _, err := stripeType(tmp.ColorOrder); err != nil {
+		return err
+	}
+	config.ColorOrder = tmp.ColorOrder
+	SetAccessiblePalette(tmp.AccessiblePalette)
+	if m := tmp.Matrix; m != nil {
+		if m.Width <= 0 || m.Height <= 0 {
+			return fmt.Errorf("matrix: width and height must be > 0")
+		}
+		config.Matrix = m
+	}
 	config.Idle.Color = strings.TrimSpace(tmp.Idle.Color)
+	config.Idle.ColorB = strings.TrimSpace(tmp.Idle.ColorB)
 	return nil
 }
 
+// InitLEDs loads config.json and makes one attempt at opening the strip.
+// Callers hold ledMutex; EnsureInit is the usual way in and retries.
 func InitLEDs() error {
 	if err := LoadConfig(); err != nil {
-		return err
+		if !simulated {
+			return err
+		}
+		log.Printf("sim: %v; using defaults", err)
+	}
+	loadStack()
+	if simulated {
+		dev = &simStrip{leds: make([]uint32, config.LedCount)}
+		log.Printf("LEDs init (simulated): %d LEDs", config.LedCount)
+		if brightnessOverride >= 0 {
+			dev.SetBrightness(0, brightnessOverride)
+		}
+		return nil
+	}
+	if err := initHardware(); err != nil {
+		return fmt.Errorf("%w: %v", errHardwareInit, err)
+	}
+	log.Printf("LEDs init: %d LEDs on GPIO %d (brightness %d)", config.LedCount, config.LedPin, config.Brightness)
+	return nil
+}
+
+// errHardwareInit marks an InitLEDs failure worth retrying: the driver,
+// not config.json.
+var errHardwareInit = errors.New("LED hardware init")
+
+// stripeTypes maps config colorOrder to the driver's strip layouts.
+var stripeTypes = map[string]int{
+	"RGB": ws2811.WS2811StripRGB,
+	"RBG": ws2811.WS2811StripRBG,
+	"GRB": ws2811.WS2811StripGRB,
+	"GBR": ws2811.WS2811StripGBR,
+	"BRG": ws2811.WS2811StripBRG,
+	"BGR": ws2811.WS2811StripBGR,
+}
+
+// stripeType resolves a colorOrder ("" = the WS2812 default, GRB).
+func stripeType(order string) (int, error) {
+	order = strings.ToUpper(strings.TrimSpace(order))
+	if order == "" {
+		return ws2811.WS2812Strip, nil
+	}
+	st, ok := stripeTypes[order]
+	if !ok {
+		return 0, fmt.Errorf("colorOrder %q: want one of RGB, RBG, GRB, GBR, BRG, BGR", order)
 	}
+	return st, nil
+}
+
+// maxInitRetryWait caps the doubling wait between init attempts.
+const maxInitRetryWait = 10 * time.Second
+
+func initHardware() error {
 	opt := ws2811.DefaultOptions
 	opt.Channels[0].GpioPin = config.LedPin
-	opt.Channels[0].Brightness = config.Brightness
+	opt.Channels[0].Brightness = currentBrightness()
 	opt.Channels[0].LedCount = config.LedCount
+	st, err := stripeType(config.ColorOrder)
+	if err != nil {
+		return err
+	}
+	opt.Channels[0].StripeType = st
 
-	var err error
-	dev, err = ws2811.MakeWS2811(&opt)
+	hw, err := ws2811.MakeWS2811(&opt)
 	if err != nil {
 		return fmt.Errorf("makeWS2811 failed: %v", err)
 	}
-	if err := dev.Init(); err != nil {
+	if err := hw.Init(); err != nil {
 		return fmt.Errorf("ws2811 init failed: %v", err)
 	}
-	log.Printf("LEDs init: %d LEDs on GPIO %d (brightness %d)", config.LedCount, config.LedPin, config.Brightness)
+	dev = hw
 	return nil
 }
 
-// EnsureInit initializes the device if needed.
+func currentBrightness() int {
+	if brightnessOverride >= 0 {
+		return brightnessOverride
+	}
+	return config.Brightness
+}
+
+// SetBrightness overrides the strip brightness (0..255) until
+// ResetBrightness; it also applies to a device initialized later.
+func SetBrightness(b int) {
+	b = max(0, min(b, 255))
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	brightnessOverride = b
+	if dev != nil {
+		dev.SetBrightness(0, b)
+	}
+}
+
+// ResetBrightness drops any override and goes back to config.json's brightness.
+func ResetBrightness() {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	brightnessOverride = -1
+	if dev != nil {
+		dev.SetBrightness(0, config.Brightness)
+	}
+}
+
+// Render failures (SPI/DMA hiccups, brown-outs) are logged at most once
+// per renderLogEvery. After maxRenderFailures in a row the playing effect
+// is aborted and the strip re-initialized once; while the streak lasts,
+// renders are only retried once a second instead of at frame rate.
+const (
+	maxRenderFailures = 10
+	renderLogEvery    = 5 * time.Second
+	renderRetryEvery  = time.Second
+)
+
+var (
+	renderFails   int
+	stripBroken   bool // set by render, cleared by EnsureInit's re-init
+	lastRenderLog time.Time
+	lastRenderTry time.Time
+	errRenderWait = errors.New("render: backing off after repeated failures")
+)
+
+// reservedPixel is a parsed config reserved entry.
+type reservedPixel struct {
+	index int
+	color uint32
+}
+
+var (
+	reserved     []reservedPixel // guarded by ledMutex
+	hideReserved atomic.Bool     // set on shutdown so the accents go dark too
+
+	// indicator is a runtime reserved range (see SetIndicator), guarded by ledMutex
+	indicator struct {
+		first, count int
+		color        uint32
+	}
+)
+
+// SetIndicator holds count LEDs from first at color over every frame, like
+// the config reserved pixels but changed at runtime (the client's latency
+// indicator); count 0 removes it. The strip is re-rendered right away so
+// the change shows even while nothing else is drawing.
+func SetIndicator(first, count int, color uint32) {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	indicator.first, indicator.count, indicator.color = max(first, 0), max(count, 0), color
+	if dev == nil {
+		return
+	}
+	_ = render()
+}
+
+// applyReserved is the last step before a frame goes out: it stamps the
+// stacked dots, the reserved accent pixels and the indicator over whatever
+// the effect drew.
+func applyReserved(leds []uint32) {
+	if hideReserved.Load() {
+		return
+	}
+	copy(leds, stack)
+	for _, r := range reserved {
+		if r.index < len(leds) {
+			leds[r.index] = r.color
+		}
+	}
+	for i := indicator.first; i < indicator.first+indicator.count && i < len(leds); i++ {
+		leds[i] = indicator.color
+	}
+}
+
+// Frame debugging (SetDebug): render logs what it sends about once a
+// second. Off, it costs render one atomic load.
+var (
+	debugFrames  atomic.Bool
+	debugRenders uint64    // renders since debugging was turned on; guarded by ledMutex
+	debugLastLog time.Time // guarded by ledMutex
+)
+
+// SetDebug turns the per-render frame summary log on or off.
+func SetDebug(on bool) {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	debugFrames.Store(on)
+	debugRenders, debugLastLog = 0, time.Time{}
+}
+
+// logFrame logs a summary of the frame going out: render count, what is
+// playing, lit LEDs, their average color and the brightness. Callers hold
+// ledMutex.
+func logFrame(leds []uint32) {
+	debugRenders++
+	if time.Since(debugLastLog) < time.Second {
+		return
+	}
+	debugLastLog = time.Now()
+
+	// stateMu is taken before ledMutex elsewhere; don't wait on it here
+	source := "?"
+	if stateMu.TryLock() {
+		source = cmp.Or(currentEffect, currentIdle, "-")
+		stateMu.Unlock()
+	}
+	var lit int
+	var r, g, b uint64
+	for _, c := range leds {
+		if c != colorOff {
+			lit++
+			r, g, b = r+uint64(c>>16&0xFF), g+uint64(c>>8&0xFF), b+uint64(c&0xFF)
+		}
+	}
+	var avg uint32
+	if lit > 0 {
+		avg = packColor(uint8(r/uint64(lit)), uint8(g/uint64(lit)), uint8(b/uint64(lit)))
+	}
+	log.Printf("debug: frame=%d source=%s lit=%d/%d avg=#%06X brightness=%d", debugRenders, source, lit, len(leds), avg, currentBrightness())
+}
+
+// render pushes the LED buffer to the strip. Callers hold ledMutex and
+// have checked dev != nil. It is the one path to dev.Render, so it also
+// enforces config maxFps: a render too soon after the last one sleeps
+// (holding ledMutex) until the interval is up.
+func render() error {
+	if stripBroken {
+		return errRenderWait
+	}
+	if renderFails >= maxRenderFailures && time.Since(lastRenderTry) < renderRetryEvery {
+		return errRenderWait
+	}
+	if config.MaxFPS > 0 {
+		if wait := time.Second/time.Duration(config.MaxFPS) - time.Since(lastRenderTry); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	lastRenderTry = time.Now()
+	if nudgeAmount > 0 {
+		// tint a copy's worth, then put the idle's own pixels back so the
+		// next render (which may not redraw them) doesn't tint twice
+		leds := dev.Leds(0)
+		nudgeSaved = append(nudgeSaved[:0], leds...)
+		for i := range leds {
+			leds[i] = frames.Lerp(leds[i], nudgeColor, nudgeAmount)
+		}
+		defer copy(leds, nudgeSaved)
+	}
+	applyReserved(dev.Leds(0))
+	if debugFrames.Load() {
+		logFrame(dev.Leds(0))
+	}
+	err := dev.Render()
+	if err == nil {
+		if renderFails > 0 {
+			log.Printf("render: recovered after %d failures", renderFails)
+			renderFails = 0
+		}
+		return nil
+	}
+	renderFails++
+	if time.Since(lastRenderLog) >= renderLogEvery {
+		log.Printf("render failed (%d in a row): %v", renderFails, err)
+		lastRenderLog = time.Now()
+	}
+	if renderFails == maxRenderFailures {
+		log.Printf("render: %d failures in a row; aborting the effect and re-initializing the strip", renderFails)
+		AbortEffect()
+		stripBroken = true
+		// not inline: init retries take seconds and our caller holds ledMutex
+		go func() {
+			if err := EnsureInit(); err != nil {
+				log.Printf("render: re-init failed: %v", err)
+			}
+		}()
+	}
+	return err
+}
+
+// initMu makes concurrent EnsureInit callers wait for one init instead of
+// each running its own retries. Taken before ledMutex, never under it.
+var initMu sync.Mutex
+
+// EnsureInit initializes the device if needed, re-initializing it when
+// render has given up on it. On a cold boot the DMA/PWM device can lag
+// behind us, so hardware failures are retried with doubling waits; the
+// waits don't hold ledMutex, so everything else keeps running meanwhile.
 func EnsureInit() error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	var wait time.Duration
+	for attempt := 1; ; attempt++ {
+		err := tryInit()
+		if err == nil || !errors.Is(err, errHardwareInit) {
+			return err
+		}
+		ledMutex.Lock()
+		attempts := config.InitRetries + 1
+		if attempt == 1 {
+			wait = time.Duration(config.InitRetryMs) * time.Millisecond
+		}
+		ledMutex.Unlock()
+		if attempt >= attempts {
+			return fmt.Errorf("LED init failed after %d attempts: %v", attempts, err)
+		}
+		log.Printf("LED init attempt %d/%d failed: %v; retrying in %s", attempt, attempts, err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxInitRetryWait {
+			wait = maxInitRetryWait
+		}
+	}
+}
+
+// tryInit is one EnsureInit attempt under ledMutex.
+func tryInit() error {
 	ledMutex.Lock()
 	defer ledMutex.Unlock()
+	if stripBroken {
+		if dev != nil {
+			dev.Fini()
+			dev = nil // stays nil if InitLEDs fails; the next EnsureInit tries again
+		}
+		// a fresh streak, so a new device that fails too gets re-initialized
+		// again instead of staying throttled at one render a second
+		renderFails, lastRenderTry = 0, time.Time{}
+	}
+	stripBroken = false
 	if dev != nil {
 		return nil
 	}
@@ -109,12 +652,67 @@ func CleanupLEDs() {
 		for i := range leds {
 			leds[i] = colorOff
 		}
-		dev.Render()
+		_ = render()
 		dev.Fini()
 		dev = nil
 	}
 }
 
+// fadingOut is set while FadeOut owns the strip, so a stopping idle leaves
+// its last frame up instead of blanking it.
+var fadingOut atomic.Bool
+
+// FadeOut dims whatever is on the strip to black over d, scaling every
+// channel of the current frame together, then clears. It stops a running
+// idle first (keeping its frame). ClearLEDs is still the instant version,
+// for aborts.
+func FadeOut(d time.Duration) {
+	fadingOut.Store(true)
+	defer fadingOut.Store(false)
+	ledMutex.Lock()
+	var snap []uint32
+	if dev != nil {
+		leds := dev.Leds(0)
+		snap = slices.Clone(leds[:min(config.LedCount, len(leds))])
+	}
+	ledMutex.Unlock()
+	StopIdle()
+
+	lit := slices.ContainsFunc(snap, func(c uint32) bool { return c != colorOff })
+	if d > 0 && lit {
+		const step = 10 * time.Millisecond
+		buf := make([]uint32, len(snap))
+		start := time.Now()
+		for elapsed := time.Duration(0); elapsed < d; elapsed = time.Since(start) {
+			f := 1 - float64(elapsed)/float64(d)
+			for i, c := range snap {
+				buf[i] = frames.Fade(c, f)
+			}
+			renderFrame(buf)
+			time.Sleep(step)
+		}
+	}
+	ClearLEDs()
+}
+
+// Shutdown takes the strip down for a clean exit: a running effect is
+// aborted (a hard clear), an idle fades out over config shutdownFadeMs,
+// then the driver is released.
+func Shutdown() {
+	if IsBusy() {
+		AbortEffect()
+		for wait := time.Now().Add(time.Second); IsBusy() && time.Now().Before(wait); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	ledMutex.Lock()
+	d := time.Duration(config.ShutdownFadeMs) * time.Millisecond
+	ledMutex.Unlock()
+	FadeOut(d)
+	hideReserved.Store(true)
+	CleanupLEDs()
+}
+
 func ClearLEDs() {
 	ledMutex.Lock()
 	defer ledMutex.Unlock()
@@ -125,7 +723,13 @@ func ClearLEDs() {
 	for i := range leds {
 		leds[i] = colorOff
 	}
-	dev.Render()
+	_ = render()
+}
+
+// packColor builds the 0xRRGGBB value the strip buffer holds; the driver
+// reorders the channels for the wire per the strip type.
+func packColor(r, g, b uint8) uint32 {
+	return uint32(r)<<16 | uint32(g)<<8 | uint32(b)
 }
 
 // parseHexColor parses "#RRGGBB" or "RRGGBB" into 0xRRGGBB as uint32.
@@ -149,15 +753,129 @@ func parseHexColor(s string) uint32 {
 
 //
 // ==================
-//  Idle: Breathing
+//  Idle runner
 // ==================
 //
 
+// One idle look runs at a time on its own goroutine. Each idle mode is a
+// callback handed to startIdle; StopIdle ends it and clears the strip.
 var (
-	breathingStopChan chan struct{}
-	breathingWg       sync.WaitGroup
+	idleMu   sync.Mutex
+	idleStop chan struct{}
+	idleWg   sync.WaitGroup
 )
 
+// panicRestartDelay spaces out restarts of something that keeps panicking.
+const panicRestartDelay = time.Second
+
+// RunSafe runs fn, recovering a panic so one bad frame can't take the
+// client down: the panic is logged with its stack, any effect aborted and
+// the strip cleared. It reports whether fn panicked.
+func RunSafe(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s panicked: %v\n%s", name, r, debug.Stack())
+			AbortEffect()
+			ClearLEDs()
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// SafeGo runs fn on its own goroutine under RunSafe, starting it again
+// (after panicRestartDelay) whenever it panics. A normal return ends it.
+func SafeGo(name string, fn func()) {
+	go func() {
+		for RunSafe(name, fn) {
+			time.Sleep(panicRestartDelay)
+			log.Printf("%s: restarting after panic", name)
+		}
+	}()
+}
+
+// startIdle stops the current idle, then runs fn until StopIdle closes
+// stop. fn must return promptly once stop is closed. The stop and the
+// start happen under one idleMu hold, so two callers racing here leave
+// exactly one idle running.
+func startIdle(name string, fn func(stop <-chan struct{})) {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	stopIdleLocked()
+	stop := make(chan struct{})
+	idleStop = stop
+	log.Printf("%s: starting", name)
+	stateMu.Lock()
+	currentIdle = name
+	stateMu.Unlock()
+	idleWg.Add(1)
+	go func() {
+		defer idleWg.Done()
+		// a panicking idle is restarted rather than leaving the strip frozen
+	run:
+		for RunSafe(name, func() { fn(stop) }) {
+			select {
+			case <-stop:
+				break run
+			case <-time.After(panicRestartDelay):
+				log.Printf("%s: restarting after panic", name)
+			}
+		}
+		log.Printf("%s: stopping", name)
+		stateMu.Lock()
+		currentIdle = ""
+		stateMu.Unlock()
+		if !fadingOut.Load() { // FadeOut takes it down from here
+			ClearLEDs()
+		}
+	}()
+}
+
+// StopIdle stops the running idle (if any) and waits until it has cleared
+// the strip, so an effect can take over.
+func StopIdle() {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	stopIdleLocked()
+}
+
+// stopIdleLocked is StopIdle for callers holding idleMu.
+func stopIdleLocked() {
+	if idleStop != nil {
+		close(idleStop)
+		idleWg.Wait()
+		idleStop = nil
+	}
+}
+
+// IdleRunning reports whether an idle look is currently running.
+func IdleRunning() bool {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	return idleStop != nil
+}
+
+// idleTicker calls tick every frame until stop is closed.
+func idleTicker(stop <-chan struct{}, frame time.Duration, tick func(now time.Time)) {
+	ticker := time.NewTicker(frame)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			tick(now)
+		}
+	}
+}
+
+//
+// ==================
+//  Idle: Breathing
+// ==================
+//
+
 // ---- 1) Keep tiny channels from quantizing to 0 after global brightness ----
 // Scales 0xRRGGBB by gain [0..1], but guarantees each non‑zero channel
 // is at least floorLSB (pre‑brightness) when gain > 0.
@@ -188,10 +906,7 @@ func scaleColorWithFloor(color uint32, gain float64, floorLSB uint32) uint32 {
 		return s
 	}
 
-	r := scale(baseR)
-	g := scale(baseG)
-	b := scale(baseB)
-	return (r << 16) | (g << 8) | b
+	return packColor(uint8(scale(baseR)), uint8(scale(baseG)), uint8(scale(baseB)))
 }
 
 // ---- 2) Compute a safe floor that survives the driver’s brightness scaling ----
@@ -222,12 +937,12 @@ func setAllLEDs(col uint32) {
 	for i := 0; i < max; i++ {
 		leds[i] = col
 	}
-	dev.Render()
+	_ = render()
 }
 
 // ---- 3) Breathing loop with a nonzero base & the new floor applied ----
 func RunBreathingEffect() {
-	StopBreathingEffect()
+	StopIdle()
 	if err := EnsureInit(); err != nil {
 		log.Printf("RunBreathingEffect: init failed: %v", err)
 		return
@@ -242,470 +957,929 @@ func RunBreathingEffect() {
 	// Pre‑compensated floor to survive global brightness scaling.
 	floor := minLSBFromGlobal()
 
-	breathingStopChan = make(chan struct{})
-	log.Println("RunBreathingEffect: starting")
-
-	breathingWg.Add(1)
-	go func() {
-		defer breathingWg.Done()
-
-		const frame = 10 * time.Millisecond // ~100 fps
-		ticker := time.NewTicker(frame)
-		defer ticker.Stop()
+	// Nonzero base so it never *intends* to go dark. Bump a touch if you still see blacks.
+	const minDuty = 0.20
+	start := time.Now()
 
-		const secondsPerCycle = 12.0
-		// Nonzero base so it never *intends* to go dark. Bump a touch if you still see blacks.
-		const minDuty = 0.20
-		omega := 2 * math.Pi / secondsPerCycle
-		start := time.Now()
-
-		for {
-			select {
-			case <-breathingStopChan:
-				log.Println("RunBreathingEffect: stopping")
-				ClearLEDs()
-				return
-
-			case now := <-ticker.C:
-				elapsed := now.Sub(start).Seconds()
-				// 0..1 sine wave; square for more time near low brightness
-				phase := (math.Sin(omega*elapsed) + 1.0) / 2.0
-				phase = phase * phase
-				brightness := minDuty + (1.0-minDuty)*phase
-
-				col := scaleColorWithFloor(baseColor, brightness, floor)
-				setAllLEDs(col)
-			}
-		}
-	}()
-}
+	startIdle("RunBreathingEffect", func(stop <-chan struct{}) {
+		idleTicker(stop, 10*time.Millisecond, func(now time.Time) { // ~100 fps
+			brightness := minDuty + (1.0-minDuty)*breathPhase(now.Sub(start))
 
-func StopBreathingEffect() {
-	if breathingStopChan != nil {
-		log.Println("StopBreathingEffect: signal stop")
-		close(breathingStopChan)
-		breathingWg.Wait()
-		breathingStopChan = nil
-	}
+			col := scaleColorWithFloor(baseColor, brightness, floor)
+			setAllLEDs(col)
+		})
+	})
 }
 
-//
-// =======================
-//  Core “Celebrate” Demo
-// =======================
-//
-
-func celebrateAnimation(done chan struct{}) {
-	go func() {
-		colors := []uint32{colorRed, colorBlue, colorGreen}
-		for _, c := range colors {
-			ledMutex.Lock()
-			if dev != nil {
-				leds := dev.Leds(0)
-				max := min(config.LedCount, len(leds))
-				for i := 0; i < max; i++ {
-					leds[i] = c
-				}
-				dev.Render()
-			}
-			ledMutex.Unlock()
-			time.Sleep(time.Second)
-		}
-		ClearLEDs()
-		close(done)
-	}()
+// breathPhase is the shared breathing curve: a 0..1 sine over a 12s cycle,
+// squared so it lingers near the low end.
+func breathPhase(elapsed time.Duration) float64 {
+	const secondsPerCycle = 12.0
+	omega := 2 * math.Pi / secondsPerCycle
+	phase := (math.Sin(omega*elapsed.Seconds()) + 1.0) / 2.0
+	return phase * phase
 }
 
-func BlinkLEDs() {
-	log.Println("🎉 Celebration Triggered!")
-
+// Breath2 breathes between two colors instead of in and out of one: each
+// channel moves from a to b and back on the breathing phase. Zero colors
+// fall back to the configured idle colors (navy ↔ teal if unset).
+func Breath2(a, b uint32) {
+	StopIdle()
 	if err := EnsureInit(); err != nil {
-		log.Printf("BlinkLEDs: init failed: %v", err)
+		log.Printf("Breath2: init failed: %v", err)
 		return
 	}
-
-	done := make(chan struct{})
-	celebrateAnimation(done)
-	<-done
+	ledMutex.Lock()
+	if a == 0 {
+		a = parseHexColor(config.Idle.Color)
+	}
+	if b == 0 {
+		b = parseHexColor(config.Idle.ColorB)
+	}
+	ledMutex.Unlock()
+	if a == 0 {
+		a = 0x000080
+	}
+	if b == 0 {
+		b = 0x008080
+	}
+	start := time.Now()
+
+	log.Printf("Breath2: #%06X <-> #%06X", a, b)
+	startIdle("Breath2", func(stop <-chan struct{}) {
+		idleTicker(stop, 10*time.Millisecond, func(now time.Time) {
+			setAllLEDs(frames.Lerp(a, b, breathPhase(now.Sub(start))))
+		})
+	})
 }
 
+// StopBreathingEffect stops whichever idle is running.
 //
-// =======================
-//  Shoot / Comet Effects
-// =======================
-//
+// Deprecated: use StopIdle; kept for callers from before other idles existed.
+func StopBreathingEffect() { StopIdle() }
+
+// Heartbeat is a breathing alternative: a lub-dub double thump at bpm
+// (clamped to 20..150 so the two thumps of one beat never run into the
+// next), resting at a dim glow between beats.
+func Heartbeat(color uint32, bpm int) {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		log.Printf("Heartbeat: init failed: %v", err)
+		return
+	}
+	if color == 0 {
+		color = colorBlue
+	}
+	if bpm <= 0 {
+		bpm = 60
+	}
+	bpm = max(20, min(bpm, 150))
+	floor := minLSBFromGlobal()
 
-func ShootLEDs() {
-	log.Println("🚀 Shoot effect triggered")
+	// lub at 0, a softer dub dubAt later; each a gaussian pulse
+	const (
+		dubAt   = 0.22 // seconds after lub
+		dubGain = 0.6
+		width   = 0.05 // seconds (sigma)
+		minDuty = 0.10
+	)
+	thump := func(t, at float64) float64 {
+		d := (t - at) / width
+		return math.Exp(-d * d / 2)
+	}
+	beat := 60.0 / float64(bpm)
+	start := time.Now()
+
+	log.Printf("Heartbeat: %d bpm", bpm)
+	startIdle("Heartbeat", func(stop <-chan struct{}) {
+		idleTicker(stop, 10*time.Millisecond, func(now time.Time) {
+			t := math.Mod(now.Sub(start).Seconds(), beat)
+			env := math.Max(thump(t, 0)+thump(t, beat), dubGain*thump(t, dubAt))
+			setAllLEDs(scaleColorWithFloor(color, minDuty+(1-minDuty)*math.Min(env, 1), floor))
+		})
+	})
+}
+
+// defaultHueDriftPeriod is one full trip around the hue wheel for HueDrift.
+const defaultHueDriftPeriod = 5 * time.Minute
 
+// HueDrift holds the whole strip at one fully saturated color that drifts
+// slowly around the hue wheel, one rotation per period (5 minutes if
+// period <= 0). It is meant as a calm ambient idle, not a show.
+func HueDrift(period time.Duration) {
+	StopIdle()
 	if err := EnsureInit(); err != nil {
-		log.Printf("ShootLEDs: init failed: %v", err)
+		log.Printf("HueDrift: init failed: %v", err)
 		return
 	}
+	if period <= 0 {
+		period = defaultHueDriftPeriod
+	}
+	start := time.Now()
+
+	log.Printf("HueDrift: %s per rotation", period)
+	startIdle("HueDrift", func(stop <-chan struct{}) {
+		// a slow drift barely moves per frame; ~20 fps is plenty
+		idleTicker(stop, 50*time.Millisecond, func(now time.Time) {
+			hue := 360 * float64(now.Sub(start)%period) / float64(period)
+			setAllLEDs(frames.HSVToRGB(hue, 1, 1))
+		})
+	})
+}
 
-	done := make(chan struct{})
-	go shootAnimation(colorBlue, 8, 20*time.Millisecond, done)
+// defaultPaletteStep is how long PaletteCycle spends on each color.
+const defaultPaletteStep = 2 * time.Second
 
-	<-done
+// PaletteCycle shows one palette color at a time across the whole strip,
+// frameDelay per color (0 = 2s), looping until the idle is stopped. With
+// blend each color crossfades into the next over its frameDelay instead of
+// switching hard. An empty palette is the default one.
+func PaletteCycle(palette []uint32, blend bool, frameDelay time.Duration) {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		log.Printf("PaletteCycle: init failed: %v", err)
+		return
+	}
+	palette = paletteOrDefault(palette)
+	if frameDelay <= 0 {
+		frameDelay = defaultPaletteStep
+	}
+	start := time.Now()
+	tick := frameDelay
+	if blend {
+		tick = 30 * time.Millisecond
+	}
+
+	log.Printf("PaletteCycle: %d colors, %s each, blend=%v", len(palette), frameDelay, blend)
+	setAllLEDs(palette[0])
+	startIdle("PaletteCycle", func(stop <-chan struct{}) {
+		idleTicker(stop, tick, func(now time.Time) {
+			steps := int(now.Sub(start) / frameDelay)
+			from := palette[steps%len(palette)]
+			if !blend {
+				setAllLEDs(from)
+				return
+			}
+			to := palette[(steps+1)%len(palette)]
+			t := float64(now.Sub(start)%frameDelay) / float64(frameDelay)
+			setAllLEDs(frames.Lerp(from, to, t))
+		})
+	})
 }
 
-func ShootBounceLEDs(headColor uint32, tail int, frameDelay time.Duration, bounces int) {
-	log.Println("🏓 Shoot bounce")
+// GradientTwinkle is a storefront idle: a still from→to gradient along the
+// strip with brief white sparkles over it. density is roughly the share of
+// LEDs that sparkle each second (0..1; 0 = 0.05). Zero colors fall back to
+// the idle colors, then navy → teal.
+func GradientTwinkle(from, to uint32, density float64) {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		log.Printf("GradientTwinkle: init failed: %v", err)
+		return
+	}
+	ledMutex.Lock()
+	if from == 0 {
+		from = parseHexColor(config.Idle.Color)
+	}
+	if to == 0 {
+		to = parseHexColor(config.Idle.ColorB)
+	}
+	ledMutex.Unlock()
+	if from == 0 {
+		from = 0x000080
+	}
+	if to == 0 {
+		to = 0x008080
+	}
+	if density <= 0 {
+		density = 0.05
+	}
+	const frame = 30 * time.Millisecond
+	bg := make([]uint32, ledCount())
+	frames.GradientFill(bg, from, to)
+	s := &frames.Sparkle{
+		Background: bg,
+		Chance:     math.Min(density, 1) * frame.Seconds(),
+		Decay:      0.15, // a sparkle lasts ~200ms
+	}
+	var buf []uint32
+
+	log.Printf("GradientTwinkle: #%06X -> #%06X, density %.2f", from, to, density)
+	startIdle("GradientTwinkle", func(stop <-chan struct{}) {
+		idleTicker(stop, frame, func(time.Time) {
+			buf = s.Step(buf, rand.Float64)
+			renderFrame(buf)
+		})
+	})
+}
 
+// SetIdleColor changes the breathing color without waiting for the next
+// config.json load ("#RRGGBB"; empty keeps the current one).
+func SetIdleColor(hexColor string) {
+	hexColor = strings.TrimSpace(hexColor)
+	if hexColor == "" {
+		return
+	}
+	ledMutex.Lock()
+	config.Idle.Color = hexColor
+	ledMutex.Unlock()
+}
+
+// SolidWarm holds the whole strip at a warm-white color temperature
+// (2000..6500K). Nothing animates; the idle just waits to be stopped.
+func SolidWarm(kelvin int) {
+	StopIdle()
 	if err := EnsureInit(); err != nil {
-		log.Printf("ShootBounceLEDs: init failed: %v", err)
+		log.Printf("SolidWarm: init failed: %v", err)
 		return
 	}
+	col := frames.WarmWhite(kelvin)
+	log.Printf("SolidWarm: %dK", kelvin)
+	startIdle("SolidWarm", func(stop <-chan struct{}) {
+		setAllLEDs(col)
+		<-stop
+	})
+}
 
-	if tail < 1 {
-		tail = 1
+//
+// ==========================
+//  Idle State (state.json)
+// ==========================
+//
+
+const stateFile = "state.json"
+
+// IdleState is the last idle look that was applied, kept on disk so a
+// restart can bring it back before the server answers.
+type IdleState struct {
+	Effect    string  `json:"effect"`
+	Color     string  `json:"color"`
+	ColorB    string  `json:"colorB,omitempty"`    // "breath2" idle only
+	Kelvin    int     `json:"kelvin,omitempty"`    // "warm" idle only
+	BPM       int     `json:"bpm,omitempty"`       // "heartbeat" idle only
+	PeriodSec int     `json:"periodSec,omitempty"` // "huedrift" idle only
+	Density   float64 `json:"density,omitempty"`   // "gradienttwinkle" idle only
+	Palette   string  `json:"palette,omitempty"`   // "palettecycle" idle only
+	Blend     bool    `json:"blend,omitempty"`     // "palettecycle" idle only
+	StepMs    int     `json:"stepMs,omitempty"`    // "palettecycle" idle only
+	Off       bool    `json:"off,omitempty"`       // strip switched off remotely
+}
+
+func defaultIdleState() IdleState {
+	return IdleState{Effect: "breath"}
+}
+
+// SaveState writes the idle state atomically (tmp file + rename).
+func SaveState(s IdleState) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
 	}
-	if bounces < 1 {
-		bounces = 1
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
 	}
+	return os.Rename(tmp, stateFile)
+}
 
-	done := make(chan struct{})
-	go func() {
-		n := config.LedCount
-		head := 0
-		dir := 1 // +1 forward, -1 backward
-		b := 0
-
-		for {
-			ledMutex.Lock()
-			if dev != nil {
-				leds := dev.Leds(0)
-				max := min(n, len(leds))
-				// clear frame
-				for i := 0; i < max; i++ {
-					leds[i] = colorOff
-				}
-				// draw head + tail
-				for t := 0; t < tail; t++ {
-					pos := head - t*dir
-					if pos >= 0 && pos < max {
-						f := 1.0 - float64(t)/float64(tail)
-						leds[pos] = fadeColor(headColor, f)
-					}
-				}
-				dev.Render()
-			}
-			ledMutex.Unlock()
-			time.Sleep(frameDelay)
-
-			// advance
-			head += dir
-			if head <= 0 {
-				head = 0
-				dir = +1
-				b++
-			} else if head >= n-1 {
-				head = n - 1
-				dir = -1
-				b++
-			}
-			if b >= bounces*2 {
-				break
-			}
+// LoadState returns the saved idle state. A missing file yields the
+// defaults; a corrupt one yields the defaults plus the parse error.
+func LoadState() (IdleState, error) {
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultIdleState(), nil
 		}
+		return defaultIdleState(), err
+	}
+	var s IdleState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return defaultIdleState(), fmt.Errorf("corrupt %s: %v", stateFile, err)
+	}
+	if strings.TrimSpace(s.Effect) == "" {
+		s.Effect = defaultIdleState().Effect
+	}
+	return s, nil
+}
 
-		ClearLEDs()
-		close(done)
-	}()
+//
+// =======================
+//  Palettes
+// =======================
+//
+
+const defaultPalette = "team"
+
+var (
+	paletteMu sync.RWMutex
+	palettes  = map[string][]uint32{
+		"team":      {colorRed, colorBlue, colorGreen},
+		"christmas": {0xFF0000, 0x00B000, 0xFFFFFF},
+		"usa":       {0xB22234, 0xFFFFFF, 0x3C3B6E},
+		"pride":     {0xE40303, 0xFF8C00, 0xFFED00, 0x008026, 0x004DFF, 0x750787},
+	}
+)
 
-	<-done
+// RegisterPalette adds or replaces a named palette (names are case-insensitive).
+func RegisterPalette(name string, colors []uint32) {
+	if len(colors) == 0 {
+		return
+	}
+	paletteMu.Lock()
+	defer paletteMu.Unlock()
+	palettes[strings.ToLower(strings.TrimSpace(name))] = append([]uint32(nil), colors...)
+}
+
+// Palette looks up a palette by name.
+func Palette(name string) ([]uint32, bool) {
+	paletteMu.RLock()
+	defer paletteMu.RUnlock()
+	p, ok := palettes[strings.ToLower(strings.TrimSpace(name))]
+	return p, ok
 }
 
-func shootAnimation(headColor uint32, tail int, frameDelay time.Duration, done chan struct{}) {
-	if tail < 1 {
-		tail = 1
+func paletteOrDefault(colors []uint32) []uint32 {
+	if len(colors) == 0 {
+		colors, _ = Palette(defaultPalette)
 	}
-	totalSteps := config.LedCount + tail
+	return accessibleColors(colors)
+}
 
-	for step := 0; step < totalSteps; step++ {
-		ledMutex.Lock()
-		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(config.LedCount, len(leds))
+// Accessible palette: for red-green colorblind viewers the built-in red and
+// green are swapped for orange and sky blue (Okabe–Ito) as palettes are
+// handed to effects, so the toggle works at runtime. It applies to every
+// palette-driven effect — celebrate/celebrate_legacy (BlinkPalette),
+// stacked_shooting/deal_won_stacked (StackedShootPalette) and the celebrate
+// fallback in RunEffect — and only to colors exactly equal to the built-in
+// red or green; colors sent with an event are left alone.
+const (
+	accessibleOrange  uint32 = 0xE69F00
+	accessibleSkyBlue uint32 = 0x56B4E9
+)
 
-			// clear
-			for i := 0; i < max; i++ {
-				leds[i] = colorOff
-			}
-			// head + tail
-			for t := 0; t < tail; t++ {
-				pos := step - t
-				if pos < 0 || pos >= max {
-					continue
-				}
-				f := 1.0 - float64(t)/float64(tail)
-				leds[pos] = fadeColor(headColor, f)
-			}
-			dev.Render()
-		}
-		ledMutex.Unlock()
-		time.Sleep(frameDelay)
+var accessiblePalette atomic.Bool
+
+// SetAccessiblePalette turns the red/green substitution on or off.
+func SetAccessiblePalette(on bool) {
+	if accessiblePalette.Swap(on) != on {
+		log.Printf("Accessible palette: %v", on)
 	}
+}
 
-	ClearLEDs()
-	close(done)
+func accessibleColors(colors []uint32) []uint32 {
+	if !accessiblePalette.Load() {
+		return colors
+	}
+	out := make([]uint32, len(colors))
+	for i, c := range colors {
+		switch c {
+		case colorRed:
+			c = accessibleOrange
+		case colorGreen:
+			c = accessibleSkyBlue
+		}
+		out[i] = c
+	}
+	return out
 }
 
 //
-// ======================
-//  Stacked Shoot Effects
-// ======================
+// =======================
+//  Frame Driver
+// =======================
 //
 
-// DealWonStackedShoot triggers the stacked comet+fill effect.
-func DealWonStackedShoot() {
-	log.Println("🏁 Deal Won → Stacked Shoot")
+// play renders each frame from seq and holds it for the frame's duration.
+// All of the math lives in the frames package; this is the only loop that
+// touches the device for animated effects.
+func play(seq frames.Seq) {
+	var lastLit, mirrored []uint32
+	gen := playGen.Load()
+	playAborted.Store(false)
+	var deadline time.Time
+	if d := effectDeadline.Load(); d != 0 {
+		deadline = time.Unix(0, d)
+	}
+	for buf, hold := range seq {
+		if playGen.Load() != gen {
+			playAborted.Store(true)
+			break
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			log.Printf("effect hit its %s cap; stopping", effectCap())
+			break
+		}
+		if mirrorFrames.Load() {
+			mirrored = frames.Mirror(mirrored, buf, ledCount())
+			buf = mirrored
+		}
+		renderFrame(buf)
+		if holdFinal.Load() && slices.ContainsFunc(buf, func(c uint32) bool { return c != colorOff }) {
+			lastLit = append(lastLit[:0], buf...)
+		}
+		if left := time.Until(deadline); !deadline.IsZero() && left < hold {
+			hold = left
+		}
+		time.Sleep(hold)
+	}
+	// most effects end by blanking; a held effect stays on its last lit frame
+	if lastLit != nil {
+		renderFrame(lastLit)
+	}
+}
 
-	if err := EnsureInit(); err != nil {
-		log.Printf("DealWonStackedShoot: init failed: %v", err)
+// Guards against absurd requests: an effect runs at most effectCap() of
+// wall-clock time (config maxEffectSeconds, default 60s) and its cycles are
+// clamped to config maxCycles (default 20).
+var (
+	maxEffectTime  atomic.Int64 // override for effectCap; 0 = use config
+	effectDeadline atomic.Int64 // unix nanos the running effect must end by; 0 = none
+)
+
+// SetMaxEffectDuration overrides the per-effect cap (0 = back to config).
+// Used by the client's self-test to keep each effect short.
+func SetMaxEffectDuration(d time.Duration) { maxEffectTime.Store(int64(d)) }
+
+// extendEffectCap lets the running effect go on until at least d from now,
+// for effects whose length is asked for explicitly. The -selftest override
+// still wins.
+func extendEffectCap(d time.Duration) {
+	if maxEffectTime.Load() > 0 {
+		return
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if currentEffect == "" {
 		return
 	}
+	if at := time.Now().Add(d).UnixNano(); at > effectDeadline.Load() {
+		effectDeadline.Store(at)
+	}
+}
 
-	done := make(chan struct{})
-	go shootStackedAnimation(
-		[]uint32{colorRed, colorBlue, colorGreen}, // rotate through these
-		8,                   // tail length
-		15*time.Millisecond, // frame delay
-		3,                   // blinks to use
-		done,
-	)
+func effectCap() time.Duration {
+	if d := time.Duration(maxEffectTime.Load()); d > 0 {
+		return d
+	}
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	return time.Duration(config.MaxEffectSeconds) * time.Second
+}
 
-	<-done
+func clampCycles(cycles int) int {
+	ledMutex.Lock()
+	limit := config.MaxCycles
+	ledMutex.Unlock()
+	if cycles > limit {
+		log.Printf("cycles %d clamped to %d", cycles, limit)
+		return limit
+	}
+	return cycles
 }
 
-// shootStackedAnimation fills the strip from the END backwards using repeated
-// “comet” passes. It now:
-//   - fires a blink once when the comet head crosses the halfway point (n/2),
-//   - blinks using the *current shotColor* (not white),
-//   - ends with a blink in the final color (optional; easy to tweak/remove).
-func shootStackedAnimation(colors []uint32, tail int, frameDelay time.Duration, blinks int, done chan struct{}) {
-	if tail < 1 {
-		tail = 1
+// playGen is bumped by AbortEffect; play stops when it changes.
+var playGen atomic.Uint64
+
+// AbortEffect ends the effect that is playing at its next frame.
+func AbortEffect() { playGen.Add(1) }
+
+// holdFinal is set while an effect runs with Params.Hold.
+var holdFinal atomic.Bool
+
+// playAborted records whether the last play was cut off by AbortEffect.
+var playAborted atomic.Bool
+
+// clearUnlessHeld blanks the strip after an effect, except a held one.
+func clearUnlessHeld() {
+	if !holdFinal.Load() {
+		endClear()
 	}
-	n := config.LedCount
-	if n <= 0 {
-		close(done)
+}
+
+// endClear blanks the strip after an effect: a config fadeOutMs fade if
+// one is set, else (or after an abort) a hard clear.
+func endClear() {
+	ledMutex.Lock()
+	d := time.Duration(config.FadeOutMs) * time.Millisecond
+	ledMutex.Unlock()
+	if d > 0 && !playAborted.Load() {
+		FadeOut(d)
 		return
 	}
+	ClearLEDs()
+}
 
-	// Filled (persist) lives at the END of the strip.
-	persist := make([]uint32, n)
-	filledStart := n // unfilled window is [0..filledStart-1]
-	colorIdx := 0
-
-	type shot struct {
-		head  int
-		color uint32
+// renderFrame copies buf onto the strip and renders it once.
+func renderFrame(buf []uint32) {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	if dev == nil {
+		return
 	}
-	var shots []shot
+	leds := dev.Leds(0)
+	max := min(config.LedCount, len(leds))
+	copy(leds[:max], buf)
+	_ = render()
+}
 
-	// Clean slate so we don't “flash” at the beginning.
-	ClearLEDs()
+func ledCount() int {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	return config.LedCount
+}
 
-	// Seed first shot.
-	shots = append(shots, shot{head: 0, color: colors[colorIdx%len(colors)]})
-	colorIdx++
+// mirrorFrames is set while an effect runs with Params.Mirror: effects draw
+// on the first half of the strip (effectLen) and play reflects it onto the
+// second, so both ends run toward the middle.
+var mirrorFrames atomic.Bool
 
-	for filledStart > 0 {
-		// ----- draw frame -----
-		ledMutex.Lock()
-		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(n, len(leds))
+// effectLen is how many LEDs an effect should draw.
+func effectLen() int {
+	n := ledCount()
+	if mirrorFrames.Load() {
+		return (n + 1) / 2
+	}
+	return n
+}
 
-			// Base = persist (already committed segments at the end)
-			for i := 0; i < max; i++ {
-				leds[i] = persist[i]
-			}
+//
+// ==================
+//  Matrix Text
+// ==================
+//
 
-			// Overlay all active shots into the current unfilled window
-			for _, s := range shots {
-				for t := 0; t < tail; t++ {
-					pos := s.head - t
-					if pos < 0 || pos >= filledStart || pos >= max {
-						continue
-					}
-					f := 1.0 - float64(t)/float64(tail)
-					leds[pos] = fadeColor(s.color, f)
-				}
-			}
-			dev.Render()
-		}
-		ledMutex.Unlock()
+// ScrollText scrolls msg across a matrix panel in a 5x7 font, one column
+// per speed, passes times (at least once). Needs "matrix" in config.json.
+func ScrollText(msg string, color uint32, speed time.Duration, passes int) error {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		return err
+	}
+	ledMutex.Lock()
+	mc := config.Matrix
+	ledMutex.Unlock()
+	if mc == nil {
+		return errors.New("ScrollText: no matrix geometry configured")
+	}
+	if speed <= 0 {
+		speed = 60 * time.Millisecond
+	}
+	m := frames.Matrix{W: mc.Width, H: mc.Height, Serpentine: mc.Serpentine}
+	play(frames.ScrollText(m, msg, color, speed, max(passes, 1)))
+	clearUnlessHeld()
+	return nil
+}
 
-		time.Sleep(frameDelay)
+//
+// ==================
+//  Number Display
+// ==================
+//
 
-		// ----- advance shots -----
-		for i := range shots {
-			shots[i].head++
-		}
+// A count shows as blocks of numberBlock lit LEDs with numberGap dark LEDs
+// between them, starting at LED 0: 7 is seven 5-LED blocks, and a 300-LED
+// strip shows up to 50.
+const (
+	numberBlock = 5
+	numberGap   = 1
+)
 
-		// If the leading shot reached the boundary, commit a chunk of 'tail' to the end.
-		if len(shots) > 0 && shots[0].head >= filledStart {
-			chunk := min(tail, filledStart)
-			for i := 0; i < chunk; i++ {
-				persist[filledStart-1-i] = shots[0].color
-			}
-			filledStart -= chunk
-			shots = shots[1:] // remove the one we just committed
-		}
+// ShowNumber shows n as blocks (see numberBlock) in a single render for
+// strips without a panel, clamping n to what fits. It stays up until
+// something else draws.
+func ShowNumber(n int, color uint32) {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		log.Printf("ShowNumber: init failed: %v", err)
+		return
+	}
+	leds := ledCount()
+	if most := frames.MaxSegments(leds, numberBlock, numberGap); n > most {
+		log.Printf("ShowNumber: %d doesn't fit on %d LEDs; showing %d", n, leds, most)
+		n = most
+	}
+	renderFrame(frames.Segments(leds, max(n, 0), numberBlock, numberGap, color))
+}
 
-		// Spawn the next shot when the LAST active shot is halfway through the current unfilled window.
-		if filledStart > 0 {
-			half := filledStart / 2
-			if len(shots) == 0 || shots[len(shots)-1].head >= half {
-				shots = append(shots, shot{head: 0, color: colors[colorIdx%len(colors)]})
-				colorIdx++
-			}
-		}
+// testPatternHold is how long the "testpattern" effect stays up.
+const testPatternHold = 10 * time.Second
+
+// TestPattern renders frames.TestPattern across the whole strip and leaves
+// it up, for checking LedCount and the color order when commissioning.
+func TestPattern() {
+	StopIdle()
+	if err := EnsureInit(); err != nil {
+		log.Printf("TestPattern: init failed: %v", err)
+		return
 	}
+	n := ledCount()
+	log.Printf("TestPattern: %d LEDs; LED 0/1/2 should be red/green/blue, LED %d yellow", n, n-1)
+	renderFrame(frames.TestPattern(n))
+}
 
-	// Final: blink using the ACTUAL segment colors (not white)
-	for b := 0; b < blinks; b++ {
-		// ON (segment colors)
-		ledMutex.Lock()
-		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(n, len(leds))
-			for i := 0; i < max; i++ {
-				leds[i] = persist[i]
-			}
-			dev.Render()
-		}
+// showTestPattern is the "testpattern" effect: the pattern for d, then clear.
+func showTestPattern(d time.Duration) {
+	TestPattern()
+	play(frames.Still(frames.TestPattern(ledCount()), d))
+	clearUnlessHeld()
+}
+
+//
+// ==================
+//  Raw Frames
+// ==================
+//
+
+// maxFrameFPS caps ShowFrame; frames arriving faster are dropped.
+const maxFrameFPS = 60
+
+var lastRawFrame time.Time
+
+// ShowFrame writes an externally computed frame straight to the strip,
+// stopping the idle first. Frames longer than LedCount are rejected;
+// shorter ones leave the remaining LEDs dark.
+func ShowFrame(buf []uint32) error {
+	if err := EnsureInit(); err != nil {
+		return err
+	}
+	ledMutex.Lock()
+	n := config.LedCount
+	if len(buf) > n {
+		ledMutex.Unlock()
+		return fmt.Errorf("frame has %d pixels, strip has %d", len(buf), n)
+	}
+	if time.Since(lastRawFrame) < time.Second/maxFrameFPS {
 		ledMutex.Unlock()
-		time.Sleep(220 * time.Millisecond)
+		return nil // rate limited
+	}
+	lastRawFrame = time.Now()
+	ledMutex.Unlock()
 
-		// OFF
-		ledMutex.Lock()
-		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(n, len(leds))
-			for i := 0; i < max; i++ {
-				leds[i] = colorOff
-			}
-			dev.Render()
+	StopIdle()
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	if dev == nil {
+		return nil
+	}
+	leds := dev.Leds(0)
+	for i := range leds {
+		leds[i] = colorOff
+		if i < len(buf) {
+			leds[i] = buf[i] & 0xFFFFFF
 		}
-		ledMutex.Unlock()
-		time.Sleep(220 * time.Millisecond)
 	}
+	return render()
+}
 
-	ClearLEDs()
-	close(done)
+//
+// =======================
+//  Core “Celebrate” Demo
+// =======================
+//
+
+func BlinkLEDs() { BlinkPalette(nil) }
+
+// BlinkPalette is the celebrate demo over the given colors (nil = "team").
+func BlinkPalette(colors []uint32) {
+	log.Println("🎉 Celebration Triggered!")
+
+	if err := EnsureInit(); err != nil {
+		log.Printf("BlinkLEDs: init failed: %v", err)
+		return
+	}
+
+	play(frames.Celebrate(effectLen(), paletteOrDefault(colors)))
 }
 
 //
 // =======================
-//  Generic Effect Helpers
+//  Shoot / Comet Effects
 // =======================
 //
 
-func fadeColor(col uint32, factor float64) uint32 {
-	if factor <= 0 {
-		return colorOff
+func ShootLEDs() { shoot(frames.CurveLinear, 0, 1) }
+
+// shoot sends one blue comet up the strip; lower intensity dims it and
+// shortens its tail.
+func shoot(curve frames.Curve, glow, intensity float64) {
+	log.Println("🚀 Shoot effect triggered")
+
+	if err := EnsureInit(); err != nil {
+		log.Printf("ShootLEDs: init failed: %v", err)
+		return
 	}
-	if factor > 1 {
-		factor = 1
+
+	tail := max(2, int(math.Round(8*intensity)))
+	play(frames.Comet(effectLen(), scaleByIntensity(colorBlue, intensity), tail, 20*time.Millisecond, curve, glow))
+}
+
+func ShootBounceLEDs(headColor uint32, tail int, frameDelay time.Duration, bounces int, curve frames.Curve, glow float64) {
+	log.Println("🏓 Shoot bounce")
+
+	if err := EnsureInit(); err != nil {
+		log.Printf("ShootBounceLEDs: init failed: %v", err)
+		return
 	}
-	r := uint32(float64((col>>16)&0xFF) * factor)
-	g := uint32(float64((col>>8)&0xFF) * factor)
-	b := uint32(float64(col&0xFF) * factor)
-	return (r << 16) | (g << 8) | b
+
+	play(frames.Bounce(effectLen(), headColor, tail, frameDelay, bounces, curve, glow))
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+//
+// =======================
+//  Converge Wipe
+// =======================
+//
+
+// ConvergeWipe wipes from both ends toward the center, blinks once when the
+// halves meet, then clears (the client resumes idle afterwards).
+func ConvergeWipe(color uint32, delay time.Duration) {
+	log.Println("🤝 Converge wipe")
+
+	if err := EnsureInit(); err != nil {
+		log.Printf("ConvergeWipe: init failed: %v", err)
+		return
 	}
-	return b
+
+	play(frames.Converge(effectLen(), color, delay, true))
 }
 
-// blinkStrip blinks the whole strip with a color for a period, 'times' times.
-func blinkStrip(times int, onColor uint32, period time.Duration) {
-	for i := 0; i < times; i++ {
-		ledMutex.Lock()
-		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(config.LedCount, len(leds))
-			for j := 0; j < max; j++ {
-				leds[j] = onColor
-			}
-			dev.Render()
-		}
-		ledMutex.Unlock()
-		time.Sleep(period)
+//
+// =======================
+//  Nudge
+// =======================
+//
+
+// Nudge tint, blended over every rendered frame; guarded by ledMutex.
+var (
+	nudgeColor  uint32
+	nudgeAmount float64 // 0 = off, 1 = the whole strip is nudgeColor
+	nudgeSaved  []uint32
+)
 
+// overlayEffects run on top of the idle: the worker neither stops the idle
+// for them nor restarts it afterwards.
+var overlayEffects = map[string]bool{"nudge": true}
+
+// OverlaysIdle reports whether effect plays over the running idle instead
+// of replacing it.
+func OverlaysIdle(effect string) bool { return overlayEffects[effect] }
+
+// Nudge is the gentlest notification: whatever the idle shows crossfades
+// toward color (0 = white) over config nudgeFadeMs, holds for dwell (0 =
+// config nudgeDwellMs), then fades back, with the idle running underneath
+// the whole time. An abort fades nothing; the tint just goes.
+func Nudge(color uint32, dwell time.Duration) {
+	if err := EnsureInit(); err != nil {
+		log.Printf("Nudge: init failed: %v", err)
+		return
+	}
+	if color == 0 {
+		color = frames.White
+	}
+	ledMutex.Lock()
+	fade := time.Duration(config.NudgeFadeMs) * time.Millisecond
+	if dwell <= 0 {
+		dwell = time.Duration(config.NudgeDwellMs) * time.Millisecond
+	}
+	ledMutex.Unlock()
+	log.Printf("Nudge #%06X: %s fade, %s dwell", color, fade, dwell)
+
+	total := 2*fade + dwell
+	gen := playGen.Load()
+	start := time.Now()
+	// render here too so a still idle (warm, off) shows the fade
+	for el := time.Duration(0); el < total && playGen.Load() == gen; el = time.Since(start) {
+		amount := 1.0
+		switch {
+		case el < fade:
+			amount = float64(el) / float64(fade)
+		case el > fade+dwell:
+			amount = float64(total-el) / float64(fade)
+		}
 		ledMutex.Lock()
+		nudgeColor, nudgeAmount = color, amount
 		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(config.LedCount, len(leds))
-			for j := 0; j < max; j++ {
-				leds[j] = colorOff
-			}
-			dev.Render()
+			_ = render()
 		}
 		ledMutex.Unlock()
-		time.Sleep(period)
+		time.Sleep(30 * time.Millisecond)
+	}
+	ledMutex.Lock()
+	nudgeAmount = 0
+	if dev != nil {
+		_ = render()
 	}
+	ledMutex.Unlock()
 }
 
-func fill(color uint32) {
-	ledMutex.Lock()
-	defer ledMutex.Unlock()
-	if dev == nil {
+//
+// =======================
+//  Countdown
+// =======================
+//
+
+// defaultCountdown is the "countdown" length when an event gives none.
+const defaultCountdown = 60 * time.Second
+
+// Countdown lights the whole strip in color and puts the LEDs out one by
+// one, one every duration/LedCount, so it goes dark as duration elapses,
+// then flashes three times. Its length is explicit, so it may run past
+// maxEffectSeconds. An abort stops it dark, without the flash.
+func Countdown(duration time.Duration, color uint32) {
+	if err := EnsureInit(); err != nil {
+		log.Printf("Countdown: init failed: %v", err)
 		return
 	}
-	leds := dev.Leds(0)
-	max := min(config.LedCount, len(leds))
-	for i := 0; i < max; i++ {
-		leds[i] = color
+	if duration <= 0 {
+		duration = defaultCountdown
+	}
+	if color == 0 {
+		color = colorRed
 	}
+	log.Printf("⏳ Countdown %s", duration)
+	extendEffectCap(duration + time.Second)
+	n := effectLen()
+	play(frames.Countdown(n, color, duration))
+	if playAborted.Load() {
+		ClearLEDs()
+		return
+	}
+	play(frames.Flash(n, color, 3, 150*time.Millisecond, 150*time.Millisecond))
+	clearUnlessHeld()
 }
 
-func colorWipe(color uint32, delay time.Duration) {
-	for i := 0; i < config.LedCount; i++ {
-		ledMutex.Lock()
-		if dev != nil {
-			dev.Leds(0)[i] = color
-			dev.Render()
-		}
-		ledMutex.Unlock()
-		time.Sleep(delay)
+//
+// =======================
+//  Charge and Burst
+// =======================
+//
+
+// ChargeBurst builds up: color creeps up the strip over chargeTime, faster
+// as it fills, then the whole strip bursts white and fades to black over
+// burstTime. An abort during the charge skips the burst.
+func ChargeBurst(color uint32, chargeTime, burstTime time.Duration) {
+	if err := EnsureInit(); err != nil {
+		log.Printf("ChargeBurst: init failed: %v", err)
+		return
+	}
+	if color == 0 {
+		color = colorBlue
 	}
+	play(frames.Charge(effectLen(), color, chargeTime))
+	if playAborted.Load() {
+		ClearLEDs()
+		return
+	}
+	setAllLEDs(frames.White)
+	time.Sleep(80 * time.Millisecond)
+	FadeOut(burstTime)
 }
 
-func wheel(pos int) uint32 {
-	pos = 255 - pos
-	switch {
-	case pos < 85:
-		return uint32((255-pos)<<16 | 0<<8 | pos)
-	case pos < 170:
-		pos -= 85
-		return uint32(0<<16 | pos<<8 | (255 - pos))
-	default:
-		pos -= 170
-		return uint32(pos<<16 | (255-pos)<<8)
+//
+// ======================
+//  Stacked Shoot Effects
+// ======================
+//
+
+// DealWonStackedShoot triggers the stacked comet+fill effect.
+func DealWonStackedShoot() { StackedShootPalette(nil, frames.CurveLinear, 0) }
+
+// StackedShootPalette is the stacked comet+fill over the given colors (nil = "team").
+func StackedShootPalette(colors []uint32, curve frames.Curve, glow float64) {
+	log.Println("🏁 Deal Won → Stacked Shoot")
+
+	if err := EnsureInit(); err != nil {
+		log.Printf("DealWonStackedShoot: init failed: %v", err)
+		return
 	}
+
+	play(frames.StackedShoot(
+		effectLen(),
+		paletteOrDefault(colors), // rotate through these
+		8,                        // tail length
+		15*time.Millisecond,      // frame delay
+		3,                        // blinks to use
+		curve,                    // tail fade
+		glow,                     // head overshoot toward white
+	))
 }
 
-func rainbowCycle(delay time.Duration) {
-	for j := 0; j < 256*3; j++ {
-		ledMutex.Lock()
-		if dev != nil {
-			leds := dev.Leds(0)
-			max := min(config.LedCount, len(leds))
-			for i := 0; i < max; i++ {
-				leds[i] = wheel((i*256/config.LedCount + j) & 255)
-			}
-			dev.Render()
-		}
-		ledMutex.Unlock()
-		time.Sleep(delay)
+//
+// =======================
+//  Generic Effect Helpers
+// =======================
+//
+
+func min(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
+}
+
+// blinkStrip blinks the whole strip with a color for a period, 'times' times.
+func blinkStrip(times int, onColor uint32, period time.Duration) {
+	play(frames.Flash(effectLen(), onColor, times, period, period))
 }
 
 //
@@ -715,79 +1889,251 @@ func rainbowCycle(delay time.Duration) {
 //
 
 func RunEffect(effect string, color uint32, cycles int) {
-	StopBreathingEffect()
+	defer beginEffect(effect)()
+	cycles = clampCycles(cycles)
+	StopIdle()
 	if err := EnsureInit(); err != nil {
 		log.Printf("RunEffect(%s): init failed: %v", effect, err)
 		return
 	}
 	defer func() {
-		ClearLEDs()
+		if holdFinal.Load() {
+			return // keep the final frame up (and the driver with it)
+		}
+		endClear()
 		CleanupLEDs()
 	}()
 
+	ledMutex.Lock()
+	n, cfg := config.LedCount, config
+	if mirrorFrames.Load() {
+		n = (n + 1) / 2
+	}
+	ledMutex.Unlock()
 	switch effect {
 	case "blink":
 		if cycles <= 0 {
 			cycles = 3
 		}
-		for c := 0; c < cycles; c++ {
-			fill(color)
-			ledMutex.Lock()
-			if dev != nil {
-				dev.Render()
-			}
-			ledMutex.Unlock()
-			time.Sleep(500 * time.Millisecond)
-			ClearLEDs()
-			time.Sleep(250 * time.Millisecond)
-		}
+		play(frames.Blink(n, color, cycles))
 
 	case "wipe":
 		if cycles <= 0 {
 			cycles = 1
 		}
-		for c := 0; c < cycles; c++ {
-			colorWipe(color, 5*time.Millisecond)
-			time.Sleep(200 * time.Millisecond)
-			ClearLEDs()
-		}
+		delay, per := frames.Pace(cfg.wipeDuration(), n, frames.RenderCost(n))
+		play(frames.Wipe(n, color, cycles, delay, per))
 
 	case "rainbow":
 		if cycles <= 0 {
 			cycles = 1
 		}
-		for c := 0; c < cycles; c++ {
-			rainbowCycle(2 * time.Millisecond)
-		}
+		delay, per := frames.Pace(cfg.rainbowDuration(), frames.RainbowSteps, frames.RenderCost(n))
+		play(frames.Rainbow(n, cycles, delay, per))
 
 	default:
 		// fallback to your existing celebrate
-		done := make(chan struct{})
-		celebrateAnimation(done)
-		<-done
+		play(frames.Celebrate(n, paletteOrDefault(nil)))
 	}
 }
 
+// Params carries what an effect may use beyond its name.
+type Params struct {
+	Color    uint32
+	Cycles   int
+	Palette  []uint32      // palette-aware effects only; nil = their default colors
+	Text     string        // scroll_text only
+	Hold     bool          // leave the last lit frame up instead of clearing
+	Curve    frames.Curve  // comet tail fade (shoot effects); zero = linear
+	HeadGlow float64       // comet head overshoot toward white, 0..1 (shoot effects)
+	Mirror   bool          // draw on half the strip and reflect it onto the other half
+	Value    int           // count only: the number to show
+	Duration time.Duration // countdown: time to drain the strip (0 = 60s); nudge: dwell (0 = config)
+
+	// Intensity 0..1 scales the show (dimmer, fewer cycles, shorter tails)
+	// for effects that support it; 0 means full, same as 1.
+	Intensity float64
+}
+
+// intensity is p.Intensity clamped to 0..1, with 0 read as 1.
+func (p Params) intensity() float64 {
+	if p.Intensity <= 0 {
+		return 1
+	}
+	return math.Min(p.Intensity, 1)
+}
+
+// scaleByIntensity dims color toward a 30% floor as intensity drops.
+func scaleByIntensity(color uint32, intensity float64) uint32 {
+	return frames.Fade(color, 0.3+0.7*intensity)
+}
+
+// effectFunc runs one named effect to completion.
+type effectFunc func(p Params)
+
+// effects is the registry RunEffectByName dispatches through.
+var effects = map[string]effectFunc{
+	"celebrate_legacy": func(p Params) { BlinkPalette(p.Palette) },
+	"shoot":            func(p Params) { shoot(p.Curve, p.HeadGlow, p.intensity()) },
+	"shoot_bounce":     func(p Params) { ShootBounceLEDs(colorBlue, 8, 15*time.Millisecond, 4, p.Curve, p.HeadGlow) },
+	"stacked_shooting": func(p Params) { StackedShootPalette(p.Palette, p.Curve, p.HeadGlow) },
+	"deal_won_stacked": func(p Params) { StackedShootPalette(p.Palette, p.Curve, p.HeadGlow) },
+	"converge": func(p Params) {
+		for i := 0; i < max(p.Cycles, 1); i++ {
+			ConvergeWipe(p.Color, 10*time.Millisecond)
+		}
+	},
+
+	"charge_burst": func(p Params) { ChargeBurst(p.Color, 3*time.Second, time.Second) },
+	"count":        func(p Params) { ShowNumber(p.Value, p.Color) },
+	"countdown":    func(p Params) { Countdown(p.Duration, p.Color) },
+	"nudge":        func(p Params) { Nudge(p.Color, p.Duration) },
+	"stack":        func(p Params) { StackOne(p.Color) },
+	"testpattern":  func(p Params) { showTestPattern(testPatternHold) },
+
+	"scroll_text": func(p Params) {
+		if err := ScrollText(p.Text, p.Color, 0, p.Cycles); err != nil {
+			log.Printf("scroll_text: %v", err)
+		}
+	},
+
+	"blink": func(p Params) {
+		i, cycles := p.intensity(), p.Cycles
+		if cycles <= 0 {
+			cycles = 3
+		}
+		RunEffect("blink", scaleByIntensity(p.Color, i), max(1, int(math.Ceil(float64(cycles)*i))))
+	},
+	"wipe":    func(p Params) { RunEffect("wipe", p.Color, p.Cycles) },
+	"rainbow": func(p Params) { RunEffect("rainbow", p.Color, p.Cycles) },
+}
+
+// EffectNames lists every effect RunEffectByName understands, sorted.
+func EffectNames() []string {
+	names := make([]string, 0, len(effects))
+	for name := range effects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// utilityEffects are dispatchable by name but are not celebrations: they
+// need a value or text, run long, tint the idle, or add to the stack bar.
+var utilityEffects = map[string]bool{
+	"count": true, "countdown": true, "nudge": true, "scroll_text": true,
+	"stack": true, "testpattern": true,
+}
+
+// ShowEffectNames is EffectNames without the utility effects: the pool a
+// "random" event with no list of its own draws from.
+func ShowEffectNames() []string {
+	return slices.DeleteFunc(EffectNames(), func(n string) bool { return utilityEffects[n] })
+}
+
+// LedCount reports the configured strip length.
+func LedCount() int { return ledCount() }
+
+// Snapshot copies the frame buffer as last rendered; nil before init.
+func Snapshot() []uint32 {
+	ledMutex.Lock()
+	defer ledMutex.Unlock()
+	if dev == nil {
+		return nil
+	}
+	return append([]uint32(nil), dev.Leds(0)...)
+}
+
 func RunEffectByName(effect string, color uint32, cycles int) {
-	switch effect {
-	case "celebrate_legacy":
-		BlinkLEDs()
-		return
-	case "shoot":
-		ShootLEDs()
-		return
-	case "shoot_bounce":
-		ShootBounceLEDs(colorBlue, 8, 15*time.Millisecond, 4)
-		return
-	case "stacked_shooting", "deal_won_stacked":
-		DealWonStackedShoot()
-		return
+	RunEffectWith(effect, Params{Color: color, Cycles: cycles})
+}
+
+// ---- what is running ----
+// Tracked cheaply for status reporting; idles don't count as busy.
+var (
+	stateMu       sync.Mutex
+	currentEffect string
+	currentIdle   string
+)
+
+// beginEffect marks effect as running and returns the func that unmarks
+// it. Nested calls (RunEffectWith → RunEffect) keep the outer name.
+func beginEffect(effect string) (end func()) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if currentEffect != "" {
+		return func() {}
+	}
+	currentEffect = effect
+	effectDeadline.Store(time.Now().Add(effectCap()).UnixNano())
+	return func() {
+		stateMu.Lock()
+		currentEffect = ""
+		effectDeadline.Store(0)
+		stateMu.Unlock()
+	}
+}
+
+// IsBusy reports whether an event effect is mid-animation.
+func IsBusy() bool { return CurrentEffect() != "" }
 
-	case "blink", "wipe", "rainbow":
-		RunEffect(effect, color, cycles)
+// CurrentEffect is the running event effect, or "" when idle or dark.
+func CurrentEffect() string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return currentEffect
+}
+
+// CurrentIdle names the running idle look (e.g. "RunBreathingEffect"),
+// or "" when none is running.
+func CurrentIdle() string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return currentIdle
+}
+
+// RunEffectWith is RunEffectByName with the full parameter set.
+func RunEffectWith(effect string, p Params) {
+	defer beginEffect(effect)()
+	p.Cycles = clampCycles(p.Cycles)
+	holdFinal.Store(p.Hold)
+	defer holdFinal.Store(false)
+	mirrorFrames.Store(p.Mirror)
+	defer mirrorFrames.Store(false)
+	if run, ok := effects[effect]; ok {
+		run(p)
 		return
+	}
+	runUnknown(effect, p)
+}
 
+// Fallbacks for an unknown effect name (config unknownEffect).
+const (
+	unknownCelebrate = "celebrate"
+	unknownDimFlash  = "dim_flash"
+	unknownNone      = "none"
+)
+
+// runUnknown handles an effect name nothing is registered under: usually a
+// typo in prefs, so it is logged loudly before the configured fallback.
+func runUnknown(effect string, p Params) {
+	if err := EnsureInit(); err != nil { // also loads config.json
+		log.Printf("unknown effect %q: init failed: %v", effect, err)
+		return
+	}
+	ledMutex.Lock()
+	fallback := config.UnknownEffect
+	ledMutex.Unlock()
+	log.Printf("⚠️ unknown effect %q (known: %s); playing fallback %q", effect, strings.Join(EffectNames(), ", "), fallback)
+	switch fallback {
+	case unknownNone:
+	case unknownDimFlash:
+		color := p.Color
+		if color == 0 {
+			color = frames.White
+		}
+		play(frames.Flash(effectLen(), frames.Fade(color, 0.2), 1, 300*time.Millisecond, 0))
 	default:
-		BlinkLEDs()
+		BlinkPalette(p.Palette)
 	}
 }
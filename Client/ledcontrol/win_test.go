@@ -0,0 +1,130 @@
+package ledcontrol
+
+import (
+	"cmp"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	ws2811 "github.com/rpi-ws281x/rpi-ws281x-go"
+)
+
+// wireBytes is what the driver clocks out for color under strip type st,
+// as its render loop does: the type's three bytes are, in wire order, the
+// shifts that pick each byte out of 0xRRGGBB.
+func wireBytes(st int, color uint32) [3]byte {
+	return [3]byte{byte(color >> (st >> 16 & 0xFF)), byte(color >> (st >> 8 & 0xFF)), byte(color >> (st & 0xFF))}
+}
+
+func TestPackColor(t *testing.T) {
+	c := packColor(0x11, 0x22, 0x33)
+	if c != 0x112233 {
+		t.Fatalf("packColor(0x11, 0x22, 0x33) = %#06x, want 0x112233", c)
+	}
+	if r, g, b := byte(c>>16), byte(c>>8), byte(c); r != 0x11 || g != 0x22 || b != 0x33 {
+		t.Errorf("channels %02X %02X %02X, want 11 22 33", r, g, b)
+	}
+	if packColor(0xFF, 0xFF, 0xFF) != 0xFFFFFF || packColor(0, 0, 0) != colorOff {
+		t.Error("white or black packed wrong")
+	}
+}
+
+func TestStripeType(t *testing.T) {
+	const r, g, b = 0x11, 0x22, 0x33
+	channel := map[rune]byte{'R': r, 'G': g, 'B': b}
+	for _, order := range []string{"RGB", "RBG", "GRB", "GBR", "BRG", "BGR", " grb ", ""} {
+		t.Run(order, func(t *testing.T) {
+			st, err := stripeType(order)
+			if err != nil {
+				t.Fatalf("stripeType(%q): %v", order, err)
+			}
+			// the wire carries the channels in the order the setting names
+			wire := cmp.Or(strings.ToUpper(strings.TrimSpace(order)), "GRB") // WS2812 default
+			var want [3]byte
+			for i, ch := range wire {
+				want[i] = channel[ch]
+			}
+			if got := wireBytes(st, packColor(r, g, b)); got != want {
+				t.Errorf("#112233 on the wire % X, want % X (%s)", got, want, wire)
+			}
+			if got := wireBytes(st, colorRed); got[strings.IndexRune(wire, 'R')] != 0xFF {
+				t.Errorf("red on the wire % X: not in the %s slot", got, wire)
+			}
+		})
+	}
+	if st, _ := stripeType(""); st != ws2811.WS2812Strip {
+		t.Errorf("default strip type %#x, want WS2812Strip", st)
+	}
+	for _, bad := range []string{"RGBW", "RRB", "red"} {
+		if _, err := stripeType(bad); err == nil {
+			t.Errorf("stripeType(%q): want an error", bad)
+		}
+	}
+}
+
+func TestShowEffectNames(t *testing.T) {
+	for name := range utilityEffects {
+		if _, ok := effects[name]; !ok {
+			t.Errorf("utility effect %q is not registered", name)
+		}
+	}
+	shows := ShowEffectNames()
+	for _, name := range shows {
+		if utilityEffects[name] {
+			t.Errorf("utility effect %q is in the random pool", name)
+		}
+	}
+	if len(shows)+len(utilityEffects) != len(effects) {
+		t.Errorf("%d shows + %d utilities != %d registered effects", len(shows), len(utilityEffects), len(effects))
+	}
+}
+
+// failStrip is a strip whose every Render fails.
+type failStrip struct{ simStrip }
+
+func (*failStrip) Render() error { return errors.New("dma hiccup") }
+
+func TestRenderFailuresReinitOutsideRender(t *testing.T) {
+	t.Chdir(t.TempDir())
+	SetSimulated(true)
+	// twice: a re-initialized strip that fails as well must be given up on
+	// (and re-initialized) again, not left throttled
+	for round := 1; round <= 2; round++ {
+		ledMutex.Lock()
+		broken := &failStrip{simStrip{leds: make([]uint32, 8)}}
+		dev = broken
+		if round == 1 {
+			renderFails, lastRenderTry = 0, time.Time{}
+		}
+		nudgeColor, nudgeAmount = colorRed, 0.5 // the tint's deferred restore must survive the give-up
+		for range maxRenderFailures {
+			if err := render(); err == nil || err == errRenderWait {
+				t.Fatalf("round %d: render on a failing strip = %v, want its error", round, err)
+			}
+		}
+		if !stripBroken || dev != broken {
+			t.Errorf("round %d: after %d failures: stripBroken=%v, dev swapped=%v; want the strip only marked", round, maxRenderFailures, stripBroken, dev != broken)
+		}
+		if err := render(); err != errRenderWait {
+			t.Errorf("round %d: render on a marked strip = %v, want errRenderWait", round, err)
+		}
+		nudgeAmount = 0
+		ledMutex.Unlock()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			ledMutex.Lock()
+			_, fresh := dev.(*simStrip)
+			done := fresh && !stripBroken
+			ledMutex.Unlock()
+			if done {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: strip was not re-initialized", round)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
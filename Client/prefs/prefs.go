@@ -0,0 +1,88 @@
+// Package prefs is the device prefs document, shared by the server that
+// stores and serves it and the client that applies it, so a field can't
+// exist on one side and be missing on the other.
+package prefs
+
+import "time"
+
+// Prefs is one device's prefs: its idle look and what each event plays.
+type Prefs struct {
+	Idle   Idle             `json:"idle"`
+	Events map[string]Event `json:"events"`
+	// Red-green colorblind mode for palette effects; nil leaves the
+	// device's own config.json setting.
+	AccessiblePalette *bool `json:"accessiblePalette,omitempty"`
+	// Locked strips have one fixed meaning (an alarm strip, say): events
+	// play the device's own prefs and broadcasts can't change the effect,
+	// color or palette.
+	Locked bool `json:"locked,omitempty"`
+}
+
+// Idle is what the strip shows between events.
+type Idle struct {
+	Effect string `json:"effect"` // one of IdleEffects
+	Color  string `json:"color"`
+	Cycles int    `json:"cycles"`
+	ColorB string `json:"colorB,omitempty"` // "breath2" idle: second color to oscillate toward
+	Kelvin int    `json:"kelvin,omitempty"` // "warm" idle: 2000..6500
+	BPM    int    `json:"bpm,omitempty"`    // "heartbeat" idle (clamped to 20..150 on the client)
+	// "huedrift" idle: seconds per full trip around the hue wheel (0 = 300)
+	PeriodSec int `json:"periodSec,omitempty"`
+	// "gradienttwinkle" idle: share of LEDs sparkling per second, 0..1 (0 = 0.05);
+	// the gradient runs from Color to ColorB
+	Density float64 `json:"density,omitempty"`
+	// "palettecycle" idle: the whole strip steps through a named palette
+	// ("" = the default), StepMs per color (0 = 2000), crossfading if Blend
+	Palette string `json:"palette,omitempty"`
+	Blend   bool   `json:"blend,omitempty"`
+	StepMs  int    `json:"stepMs,omitempty"`
+}
+
+// Event is the effect one event type plays.
+type Event struct {
+	Effect     string   `json:"effect"`            // "random" picks from Effects each time
+	Effects    []string `json:"effects,omitempty"` // pool for "random"; empty = every show effect the device has
+	Colors     []string `json:"colors,omitempty"`  // palette effects use all of them; others get one picked per event
+	Color      string   `json:"color"`
+	Cycles     int      `json:"cycles"`
+	Brightness *int     `json:"brightness,omitempty"` // 0..255; nil keeps the strip's brightness
+	Palette    string   `json:"palette,omitempty"`    // named palette (resolved on the client)
+	Text       string   `json:"text,omitempty"`       // scroll_text banner (matrix panels)
+	ResumeIdle *bool    `json:"resumeIdle,omitempty"` // false = strip holds the effect's final frame (default true)
+	FadeCurve  string   `json:"fadeCurve,omitempty"`  // comet tails: linear | exp | gamma
+	HeadGlow   float64  `json:"headGlow,omitempty"`   // comet head overshoot toward white, 0..1
+	Mirror     bool     `json:"mirror,omitempty"`     // reflect the effect about the strip's middle
+	CooldownMs int      `json:"cooldownMs,omitempty"` // repeats of this event within the window are dropped
+
+	// Override replaces the event until its ExpiresAt (a weekend promo,
+	// say); after that the fields above apply again. See Active.
+	Override *Event `json:"override,omitempty"`
+	// Override only: when it stops applying, RFC 3339 with an offset. It
+	// is compared as an instant, so write it in UTC ("...Z") and convert
+	// local promo end times yourself.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Active is the event as it plays at now: the override while one is set
+// and unexpired, else the base event. The result carries no override.
+func (e Event) Active(now time.Time) Event {
+	if o := e.Override; o != nil && o.ExpiresAt != nil && now.Before(*o.ExpiresAt) {
+		a := *o
+		a.ExpiresAt = nil
+		return a
+	}
+	e.Override = nil
+	return e
+}
+
+// OverrideExpired reports whether e has an override that no longer applies.
+func (e Event) OverrideExpired(now time.Time) bool {
+	return e.Override != nil && (e.Override.ExpiresAt == nil || !now.Before(*e.Override.ExpiresAt))
+}
+
+// RandomEffect as an event's effect picks one from its Effects pool.
+const RandomEffect = "random"
+
+// IdleEffects are the idle modes the client knows. "off" leaves the strip
+// dark between events.
+var IdleEffects = []string{"breath", "breath2", "gradienttwinkle", "heartbeat", "huedrift", "off", "palettecycle", "vumeter", "warm"}
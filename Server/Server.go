@@ -1,21 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"embed"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
+	stdcolor "image/color"
+	"image/png"
+	"io/fs"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"celebration/frames"
+	"celebration/prefs"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 )
@@ -26,24 +45,13 @@ type Device struct {
 	ID     string `json:"deviceId"`
 	Secret string `json:"deviceSecret"`
 	Label  string `json:"label"`
-}
-
-type Prefs struct {
-	Idle struct {
-		Effect string `json:"effect"`
-		Color  string `json:"color"`
-		Cycles int    `json:"cycles"`
-	} `json:"idle"`
-	Events map[string]struct {
-		Effect string `json:"effect"`
-		Color  string `json:"color"`
-		Cycles int    `json:"cycles"`
-	} `json:"events"`
+	Group  string `json:"group,omitempty"` // optional, for bulk operations (POST /prefs/bulk)
 }
 
 type RegisterReq struct {
 	Label    string `json:"label"`
 	DeviceID string `json:"deviceId,omitempty"` // optional custom id
+	Group    string `json:"group,omitempty"`    // optional group, e.g. "sales"
 }
 type RegisterResp struct {
 	DeviceID     string `json:"deviceId"`
@@ -51,60 +59,293 @@ type RegisterResp struct {
 }
 
 type Broadcast struct {
-	Type     string `json:"type"`
-	Effect   string `json:"effect"`
-	Color    string `json:"color"`
-	Cycles   int    `json:"cycles"`
-	DeviceID string `json:"deviceId,omitempty"` // optional target
+	Type       string   `json:"type"`
+	Effect     string   `json:"effect"`
+	Color      string   `json:"color"`
+	Cycles     int      `json:"cycles"`
+	Brightness *int     `json:"brightness,omitempty"` // optional 0..255 override
+	Palette    string   `json:"palette,omitempty"`    // optional named palette
+	Text       string   `json:"text,omitempty"`       // optional scroll_text banner
+	FadeCurve  string   `json:"fadeCurve,omitempty"`  // optional comet tail fade
+	HeadGlow   float64  `json:"headGlow,omitempty"`   // optional comet head overshoot, 0..1
+	Mirror     bool     `json:"mirror,omitempty"`     // optional: reflect about the middle
+	Intensity  *float64 `json:"intensity,omitempty"`  // optional 0..1 show size (e.g. deal size); nil = full
+	StartAt    int64    `json:"startAt,omitempty"`    // optional unix millis to start at, for strips firing in sync
+	DurationMs int      `json:"durationMs,omitempty"` // optional "countdown" length (0 = 60s) or "nudge" dwell (0 = the device's config)
+	DeviceID   string   `json:"deviceId,omitempty"`   // optional target
+	Label      string   `json:"label,omitempty"`      // optional target by device label; must be unique
+
+	// Optional, all-devices broadcasts only: ids to skip (e.g. a strip under
+	// maintenance). Never forwarded to clients.
+	ExcludeDeviceIDs []string `json:"excludeDeviceIds,omitempty"`
+
+	// Optional; a repeat within idempotencyTTL is acknowledged but not sent.
+	// The Idempotency-Key header works too. Never forwarded to clients.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Type "frame" only: raw pixels, base64 of big-endian uint32 0x00RRGGBB
+	// per LED. Sent as its own envelope type so older clients ignore it.
+	Frame string `json:"frame,omitempty"`
+
+	// Type "count" only: the number to show as blocks on the strip.
+	Value *int `json:"value,omitempty"`
+}
+
+// maxFrameLeds bounds a raw frame; clients also check it against LedCount.
+const maxFrameLeds = 4096
+
+// Envelope wraps every websocket message in both directions. Receivers
+// ignore types they don't know, so new ones can be added safely.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+const protoVersion = 1
+
+// Build info, stamped at build time and reported by GET /version:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)" .
+//
+// commit and buildTime fall back to the Go toolchain's VCS stamp, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+// wsSubprotocol is the websocket subprotocol for protoVersion. Clients must
+// offer it; a socket without it (a browser test tool, say) is refused
+// before auth, unless WS_ALLOW_LEGACY=1 lets older clients in during a
+// rollout.
+var (
+	wsSubprotocol = fmt.Sprintf("celebration.v%d", protoVersion)
+	wsAllowLegacy = os.Getenv("WS_ALLOW_LEGACY") == "1"
+)
+
+// Hello is what a client reports about itself right after connecting.
+type Hello struct {
+	Type     string   `json:"type,omitempty"` // "hello" on pre-envelope clients
+	Version  string   `json:"version"`
+	Effects  []string `json:"effects"`
+	LedCount int      `json:"ledCount"`
+	Protocol string   `json:"protocol,omitempty"` // negotiated subprotocol, filled in here; "" = legacy
+}
+
+type DeviceInfo struct {
+	ID        string     `json:"deviceId"`
+	Label     string     `json:"label"`
+	Group     string     `json:"group,omitempty"`
+	Connected bool       `json:"connected"`
+	LastSeen  *time.Time `json:"lastSeen"`
+	Hello     *Hello     `json:"hello,omitempty"`
+}
+
+type DeviceStatus struct {
+	Connected   bool       `json:"connected"`
+	LastSeen    *time.Time `json:"lastSeen"`
+	EffectCount int        `json:"effectCount"`
+	WriteErrors int        `json:"writeErrors"` // messages that failed to send (socket dropped)
+}
+
+// liveness per device (in memory; resets on restart)
+type deviceStats struct {
+	lastSeen    time.Time
+	effects     int
+	writeErrors int
+	hello       *Hello
+	frame       *FrameSnapshot // last get_frame reply
+	frameAt     time.Time      // when it arrived
+}
+
+// FrameSnapshot is a device's get_frame reply: its strip as last rendered,
+// "RRGGBB" per LED from LED 0.
+type FrameSnapshot struct {
+	Leds     string `json:"leds"`
+	LedCount int    `json:"ledCount"`
+	At       int64  `json:"at"` // device clock, unix millis
 }
 
 // ---------- Globals ----------
 
 var (
-	dataDir    = env("DATA_DIR", ".data")
-	devFile    = filepath.Join(dataDir, "devices.json")
-	prefsDir   = filepath.Join(dataDir, "prefs")
-	upgrader   = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	dataDir  = env("DATA_DIR", ".data")
+	devFile  = filepath.Join(dataDir, "devices.json")
+	prefsDir = filepath.Join(dataDir, "prefs")
+	upgrader = websocket.Upgrader{
+		CheckOrigin:  checkWSOrigin,
+		Subprotocols: []string{wsSubprotocol},
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			writeError(w, reason.Error(), status)
+		},
+		// permessage-deflate, used when the client offers it; WS_COMPRESSION=0
+		// turns it off for proxies that mangle it
+		EnableCompression: os.Getenv("WS_COMPRESSION") != "0",
+	}
 	devMu      sync.RWMutex
 	devices    = map[string]Device{}
 	wsMu       sync.Mutex
-	wsByDevice = map[string]map[*websocket.Conn]struct{}{}
+	wsByDevice = map[string]map[*wsConn]struct{}{}
+	prefsMu    sync.Mutex // serializes read-modify-write of prefs files
+	statsMu    sync.Mutex
+	stats      = map[string]*deviceStats{}
 	adminKey   string
+
+	// Origins allowed to call the REST API from a browser (CORS_ORIGINS,
+	// comma-separated; "*" for any). Empty = same-origin only.
+	corsOrigins = parseOrigins(os.Getenv("CORS_ORIGINS"))
+
+	// Browser origins allowed to open the websocket (WS_ORIGINS, same
+	// format). Devices send no Origin and pages from this server match
+	// their own host, so neither needs listing.
+	wsOrigins = parseOrigins(os.Getenv("WS_ORIGINS"))
+
+	// Websocket keepalive (WS_READ_TIMEOUT / WS_PING_INTERVAL, e.g. "90s").
+	// Raise both for high-latency links; the timeout should cover ~3 pings.
+	wsReadTimeout, wsPingInterval = keepaliveFromEnv(90*time.Second, 25*time.Second)
+
+	// LOG_HEADERS=1 adds request headers (secrets redacted) to access logs.
+	logHeaders = os.Getenv("LOG_HEADERS") == "1"
+
+	// WS_MAX_CONNS_PER_DEVICE caps live sockets per device id; past it the
+	// oldest is closed, so a client that reconnects without closing can't
+	// pile them up.
+	maxConnsPerDevice = envInt("WS_MAX_CONNS_PER_DEVICE", 2)
+
+	// FAKE_DEVICES=1 is for testing webhook senders without hardware: each
+	// target device with no socket is logged and counted as one send
+	// instead of going nowhere. A targeted broadcast's device counts
+	// whether registered or not; an all-device one counts every registered
+	// device not excluded. Never set it in prod.
+	fakeDevices = os.Getenv("FAKE_DEVICES") == "1"
 )
 
 // ---------- Main ----------
 
 func main() {
+	loadAdminKey()
 	must(os.MkdirAll(prefsDir, 0o755))
-	must(loadDevices())
+	if err := loadDevices(); err != nil {
+		// keep serving so the failure shows up in /healthz instead of a crash loop
+		log.Printf("load devices: %v (not ready; device writes disabled)", err)
+		devicesLoadErr = err
+	}
+	must(loadDefaults())
+	if fakeDevices {
+		log.Println("⚠️ FAKE_DEVICES=1: broadcasts to devices without a socket are logged, not sent")
+	}
 
-	r := chi.NewRouter()
+	r := newRouter()
 
-	// health
-	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+	addr := ":" + env("PORT", "8080")
+	cert, key := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if cert == "" || key == "" {
+		log.Printf("Server listening on %s (data dir: %s)", addr, dataDir)
+		log.Fatal(http.ListenAndServe(addr, r))
+	}
+	if redir := os.Getenv("HTTP_REDIRECT_ADDR"); redir != "" {
+		go func() {
+			log.Printf("Redirecting http on %s to https", redir)
+			log.Fatal(http.ListenAndServe(redir, httpsRedirect(addr)))
+		}()
+	}
+	log.Printf("Server listening on %s with TLS (data dir: %s)", addr, dataDir)
+	log.Fatal(http.ListenAndServeTLS(addr, cert, key, r))
+}
+
+// newRouter wires up every route; main serves it and tests wrap it in
+// httptest.
+func newRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(logRequests)
+	r.Use(cors)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, "not found", http.StatusNotFound)
 	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	// health: /healthz is a bare liveness probe, /readyz the detailed report
+	r.Get("/healthz", handleHealthz)
+	r.Get("/readyz", handleReadyz)
+	r.Get("/version", handleVersion)
 
 	// registration (open by default; protect if you prefer)
 	r.Post("/register", handleRegister)
 
+	// device listing (with last hello)
+	r.With(adminOnly).Get("/devices", handleListDevices)
+
+	// what a prefs document may contain (JSON Schema)
+	r.Get("/prefs/schema", handlePrefsSchema)
+
+	// same prefs to many devices (seasonal themes)
+	r.With(adminOnly).Post("/prefs/bulk", handleBulkPrefs)
+
 	// per-device prefs
 	r.Route("/devices/{id}", func(r chi.Router) {
 		r.Get("/prefs", handleGetPrefs)                              // read: public
+		r.Get("/status", handleDeviceStatus)                         // read: public
 		r.With(adminOnly).Put("/prefs", handlePutPrefs)              // write: admin
+		r.With(adminOnly).Patch("/prefs", handlePatchPrefs)          // merge: admin
 		r.With(adminOnly).Post("/notify-config", handleNotifyConfig) // push: admin
+		r.With(adminOnly).Post("/test", handleDeviceTest)            // one-off effect: admin
+		r.With(adminOnly).Get("/history", handleDeviceHistory)       // activity feed: admin
+		r.With(adminOnly).Post("/disconnect", handleDisconnect)      // kick its sockets: admin
+		r.With(adminOnly).Get("/frame", handleDeviceFrame)           // live LED buffer: admin
 	})
 
+	// effect preview for the admin UI
+	r.With(adminOnly).Post("/preview", handlePreview)
+
 	// dev/test broadcast helper
 	r.With(adminOnly).Post("/test/broadcast", handleTestBroadcast)
+	r.With(adminOnly).Post("/test/wave", handleWave)
 
 	// websocket for devices
 	r.Get("/ws", handleWS)
 
-	addr := ":" + env("PORT", "8080")
-	log.Printf("Server listening on %s (data dir: %s)", addr, dataDir)
-	log.Fatal(http.ListenAndServe(addr, r))
+	// admin dashboard (DASHBOARD=0 to turn off); its API calls need the key
+	if os.Getenv("DASHBOARD") != "0" {
+		r.Handle("/*", dashboardHandler())
+	}
+	return r
+}
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the embedded dashboard: a device list with
+// status, a test-effect button and a prefs editor, all driven by the REST
+// API above.
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // the embed pattern guarantees the directory
+	}
+	return http.FileServerFS(sub)
+}
+
+// TLS: set TLS_CERT and TLS_KEY to PEM files to terminate TLS (and wss)
+// here instead of behind a proxy. TLS_CERT holds the leaf certificate
+// followed by any intermediates; TLS_KEY holds the matching unencrypted
+// private key (PKCS#1, PKCS#8 or EC). Optionally set HTTP_REDIRECT_ADDR
+// (e.g. ":80") to also listen for plain HTTP and redirect it to https.
+
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
 }
 
 // ---------- Helpers ----------
@@ -115,6 +356,34 @@ func env(k, def string) string {
 	}
 	return def
 }
+
+// envDuration reads a Go duration ("90s", "2m") or plain seconds.
+func envDuration(k string, def time.Duration) time.Duration {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	log.Printf("%s=%q is not a duration; using %s", k, v, def)
+	return def
+}
+
+// keepaliveFromEnv returns the read timeout and ping interval, keeping the
+// interval below the timeout so a healthy peer never times out.
+func keepaliveFromEnv(readDef, pingDef time.Duration) (read, ping time.Duration) {
+	read = envDuration("WS_READ_TIMEOUT", readDef)
+	ping = envDuration("WS_PING_INTERVAL", pingDef)
+	if ping >= read {
+		log.Printf("WS_PING_INTERVAL %s >= WS_READ_TIMEOUT %s; pinging every %s", ping, read, read/3)
+		ping = read / 3
+	}
+	return read, ping
+}
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -124,6 +393,19 @@ func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(v)
 }
+
+// writeError is http.Error with a JSON body: {"error": msg, "code": ...},
+// code being the status text in snake_case ("not_found", "bad_request").
+func writeError(w http.ResponseWriter, msg string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": errorCode(status)})
+}
+
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
 func randHex(n int) string {
 	b := make([]byte, n)
 	_, _ = rand.Read(b)
@@ -137,7 +419,7 @@ func secureCompare(a, b string) bool {
 	return hmac.Equal(aa, bb)
 }
 
-func init() {
+func loadAdminKey() {
 	data, err := os.ReadFile("/etc/secrets/admin_key.txt")
 	if err != nil {
 		log.Fatalf("failed to read admin key: %v", err)
@@ -150,12 +432,130 @@ func init() {
 func adminOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if adminKey == "" {
-			http.Error(w, "admin key not configured", http.StatusForbidden)
+			writeError(w, "admin key not configured", http.StatusForbidden)
 			return
 		}
 		got := r.Header.Get("X-Admin-Key")
 		if !secureCompare(got, adminKey) {
-			http.Error(w, "forbidden", http.StatusForbidden)
+			writeError(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Access log: one line per request with status and latency.
+
+var redactedHeaders = map[string]bool{"X-Admin-Key": true, "X-Auth-Sig": true, "Authorization": true}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Hijack keeps websocket upgrades working through the recorder.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		line := fmt.Sprintf("http method=%s path=%s status=%d dur=%s remote=%s",
+			r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Microsecond), r.RemoteAddr)
+		if id := r.Header.Get("X-Device-ID"); id != "" {
+			line += " device=" + id
+		}
+		if logHeaders {
+			line += " headers=" + redactHeaders(r.Header)
+		}
+		log.Print(line)
+	})
+}
+
+func redactHeaders(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.Join(h[k], ",")
+		if redactedHeaders[k] {
+			v = "[redacted]"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// CORS: only origins listed in CORS_ORIGINS get Access-Control-* headers.
+// Preflights are answered here, before routing, so every route accepts them.
+
+func parseOrigins(v string) map[string]bool {
+	m := map[string]bool{}
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			m[o] = true
+		}
+	}
+	return m
+}
+
+// checkWSOrigin is the upgrader's CheckOrigin: no Origin (a device), the
+// server's own host, or a WS_ORIGINS entry. Anything else is a browser
+// page elsewhere and gets a 403, so it can't ride a visitor's session.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || wsOrigins["*"] || wsOrigins[strings.TrimRight(origin, "/")] {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	log.Printf("WS: refusing origin %q (not in WS_ORIGINS)", origin)
+	return false
+}
+
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && (corsOrigins["*"] || corsOrigins[origin]) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Key, If-Match, Idempotency-Key")
+			h.Set("Access-Control-Expose-Headers", "ETag")
+			h.Set("Access-Control-Max-Age", "600")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -177,9 +577,17 @@ func loadDevices() error {
 		return err
 	}
 	defer f.Close()
-	return json.NewDecoder(f).Decode(&devices)
+	if err := json.NewDecoder(f).Decode(&devices); err != nil {
+		devices = map[string]Device{}
+		return fmt.Errorf("%s: %v", devFile, err)
+	}
+	return nil
 }
 func saveDevices() error {
+	if devicesLoadErr != nil {
+		// don't overwrite a devices.json we couldn't read
+		return fmt.Errorf("device DB failed to load: %v", devicesLoadErr)
+	}
 	devMu.RLock()
 	defer devMu.RUnlock()
 	tmp := devFile + ".tmp"
@@ -208,27 +616,47 @@ func deviceSecret(id string) string {
 	}
 	return ""
 }
+func deviceLabel(id string) string {
+	devMu.RLock()
+	defer devMu.RUnlock()
+	if d, ok := devices[id]; ok {
+		return d.Label
+	}
+	return ""
+}
+
+// deviceByLabel finds the one device with this label (trimmed, any case),
+// with the HTTP status to use when there is none or more than one.
+func deviceByLabel(label string) (string, int, error) {
+	label = strings.TrimSpace(label)
+	var ids []string
+	devMu.RLock()
+	for id, d := range devices {
+		if strings.EqualFold(strings.TrimSpace(d.Label), label) {
+			ids = append(ids, id)
+		}
+	}
+	devMu.RUnlock()
+	switch len(ids) {
+	case 0:
+		return "", http.StatusNotFound, fmt.Errorf("no device labelled %q", label)
+	case 1:
+		return ids[0], 0, nil
+	}
+	sort.Strings(ids)
+	return "", http.StatusConflict, fmt.Errorf("label %q is ambiguous: %s", label, strings.Join(ids, ", "))
+}
 
 // ---------- Prefs (prefs/<id>.json) ----------
 
 func prefsPath(id string) string { return filepath.Join(prefsDir, id+".json") }
 
-func readPrefs(id string) (Prefs, error) {
-	var p Prefs
+func readPrefs(id string) (prefs.Prefs, error) {
+	var p prefs.Prefs
 	b, err := os.ReadFile(prefsPath(id))
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			p.Idle.Effect, p.Idle.Color, p.Idle.Cycles = "breath", "#0000ff", 0
-			p.Events = map[string]struct {
-				Effect string `json:"effect"`
-				Color  string `json:"color"`
-				Cycles int    `json:"cycles"`
-			}{
-				"deal_won":        {Effect: "blink", Color: "#00ff00", Cycles: 3},
-				"account_created": {Effect: "wipe", Color: "#00ffaa", Cycles: 2},
-				"celebrate":       {Effect: "blink", Color: "#ff7f00", Cycles: 1},
-			}
-			return p, nil
+			return defaultPrefs(), nil
 		}
 		return p, err
 	}
@@ -236,15 +664,64 @@ func readPrefs(id string) (Prefs, error) {
 		return p, err
 	}
 	if p.Events == nil {
-		p.Events = map[string]struct {
-			Effect string `json:"effect"`
-			Color  string `json:"color"`
-			Cycles int    `json:"cycles"`
-		}{}
+		p.Events = map[string]prefs.Event{}
 	}
 	return p, nil
 }
-func writePrefs(id string, p Prefs) error {
+
+// Defaults for devices without a prefs file. DEFAULTS_FILE (default
+// defaults.json) overrides the built-in ones so strips ship pre-branded;
+// it has the same shape as a prefs document.
+var (
+	defaultsFile = env("DEFAULTS_FILE", "defaults.json")
+	defaults     = builtinPrefs()
+)
+
+func builtinPrefs() prefs.Prefs {
+	var p prefs.Prefs
+	p.Idle.Effect, p.Idle.Color, p.Idle.Cycles = "breath", "#0000ff", 0
+	p.Events = map[string]prefs.Event{
+		"deal_won":        {Effect: "blink", Color: "#00ff00", Cycles: 3},
+		"account_created": {Effect: "wipe", Color: "#00ffaa", Cycles: 2},
+		"celebrate":       {Effect: "blink", Color: "#ff7f00", Cycles: 1},
+	}
+	return p
+}
+
+func loadDefaults() error {
+	b, err := os.ReadFile(defaultsFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var p prefs.Prefs
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("%s: %v", defaultsFile, err)
+	}
+	if err := validatePrefs(p); err != nil {
+		return fmt.Errorf("%s: %v", defaultsFile, err)
+	}
+	if p.Events == nil {
+		p.Events = map[string]prefs.Event{}
+	}
+	defaults = p
+	log.Printf("Loaded default prefs from %s (%d events)", defaultsFile, len(p.Events))
+	return nil
+}
+
+// defaultPrefs returns a copy callers may modify.
+func defaultPrefs() prefs.Prefs {
+	p := defaults
+	p.Events = make(map[string]prefs.Event, len(defaults.Events))
+	for k, v := range defaults.Events {
+		p.Events[k] = v
+	}
+	return p
+}
+
+func writePrefs(id string, p prefs.Prefs) error {
 	_ = os.MkdirAll(prefsDir, 0o755)
 	tmp := prefsPath(id) + ".tmp"
 	if err := os.WriteFile(tmp, mustJSON(p), 0o644); err != nil {
@@ -252,6 +729,220 @@ func writePrefs(id string, p Prefs) error {
 	}
 	return os.Rename(tmp, prefsPath(id))
 }
+
+// maxCycles bounds any cycles value the server will store or forward;
+// clients clamp again against their own config.
+const maxCycles = 20
+
+// maxCooldownMs caps an event's cooldown at an hour.
+const maxCooldownMs = 60 * 60 * 1000
+
+// HueDrift rotation bounds: faster than 10s stops being calm, slower than
+// a day is indistinguishable from a solid color.
+const (
+	minHueDriftSec = 10
+	maxHueDriftSec = 24 * 60 * 60
+)
+
+// PaletteCycle step bounds: under 100ms is a strobe, not an idle.
+const (
+	minPaletteStepMs = 100
+	maxPaletteStepMs = 60 * 60 * 1000
+)
+
+func validCycles(c int) error {
+	if c < 0 || c > maxCycles {
+		return fmt.Errorf("must be 0..%d", maxCycles)
+	}
+	return nil
+}
+
+// FieldError is one problem in a prefs document, e.g.
+// {"field":"events.deal_won.cycles","message":"must be 0..20"}.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// PrefsErrors is everything validatePrefs found wrong, in field order.
+type PrefsErrors []FieldError
+
+func (e PrefsErrors) Error() string {
+	parts := make([]string, len(e))
+	for i, f := range e {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// validatePrefs is the one check every prefs write goes through (PUT,
+// PATCH, defaults.json). It returns PrefsErrors listing every bad field,
+// and mirrors what prefsSchema publishes.
+func validatePrefs(p prefs.Prefs) error {
+	var errs PrefsErrors
+	bad := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, FieldError{field, err.Error()})
+		}
+	}
+	if e := strings.ToLower(strings.TrimSpace(p.Idle.Effect)); e != "" && !slices.Contains(prefs.IdleEffects, e) {
+		bad("idle.effect", fmt.Errorf("must be one of %s", strings.Join(prefs.IdleEffects, ", ")))
+	}
+	bad("idle.color", validColor(p.Idle.Color))
+	bad("idle.cycles", validCycles(p.Idle.Cycles))
+	bad("idle.colorB", validColor(p.Idle.ColorB))
+	if k := p.Idle.Kelvin; k != 0 && (k < 2000 || k > 6500) {
+		bad("idle.kelvin", errors.New("must be 2000..6500"))
+	}
+	if b := p.Idle.BPM; b < 0 {
+		bad("idle.bpm", errors.New("must be >= 0"))
+	}
+	if d := p.Idle.Density; d < 0 || d > 1 {
+		bad("idle.density", errors.New("must be 0..1"))
+	}
+	if s := p.Idle.PeriodSec; s != 0 && (s < minHueDriftSec || s > maxHueDriftSec) {
+		bad("idle.periodSec", fmt.Errorf("must be %d..%d", minHueDriftSec, maxHueDriftSec))
+	}
+	if s := p.Idle.StepMs; s != 0 && (s < minPaletteStepMs || s > maxPaletteStepMs) {
+		bad("idle.stepMs", fmt.Errorf("must be %d..%d", minPaletteStepMs, maxPaletteStepMs))
+	}
+	checkEvent := func(field string, ev prefs.Event) {
+		if strings.TrimSpace(ev.Effect) == "" {
+			bad(field+"effect", errors.New("required"))
+		}
+		bad(field+"color", validColor(ev.Color))
+		for i, c := range ev.Colors {
+			bad(fmt.Sprintf("%scolors[%d]", field, i), validColor(c))
+		}
+		for i, e := range ev.Effects {
+			if strings.TrimSpace(e) == "" || strings.EqualFold(strings.TrimSpace(e), prefs.RandomEffect) {
+				bad(fmt.Sprintf("%seffects[%d]", field, i), errors.New("must name a real effect"))
+			}
+		}
+		bad(field+"cycles", validCycles(ev.Cycles))
+		bad(field+"brightness", validBrightness(ev.Brightness))
+		if _, ok := frames.ParseCurve(ev.FadeCurve); !ok {
+			bad(field+"fadeCurve", errors.New("must be linear, exp or gamma"))
+		}
+		if ev.HeadGlow < 0 || ev.HeadGlow > 1 {
+			bad(field+"headGlow", errors.New("must be 0..1"))
+		}
+		if ev.CooldownMs < 0 || ev.CooldownMs > maxCooldownMs {
+			bad(field+"cooldownMs", fmt.Errorf("must be 0..%d", maxCooldownMs))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(p.Events)) {
+		ev, field := p.Events[name], "events."+name+"."
+		checkEvent(field, ev)
+		if ev.ExpiresAt != nil {
+			bad(field+"expiresAt", errors.New("only allowed inside override"))
+		}
+		if o := ev.Override; o != nil {
+			checkEvent(field+"override.", *o)
+			if o.ExpiresAt == nil {
+				bad(field+"override.expiresAt", errors.New("required"))
+			}
+			if o.Override != nil {
+				bad(field+"override.override", errors.New("overrides don't nest"))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validColor accepts "" (the effect's default) or #RRGGBB.
+func validColor(c string) error {
+	if c == "" {
+		return nil
+	}
+	_, err := parseColor(c)
+	return err
+}
+
+// writePrefsError answers a failed validatePrefs with 400 and, for
+// PrefsErrors, the field-level list.
+func writePrefsError(w http.ResponseWriter, err error) {
+	var fields PrefsErrors
+	if !errors.As(err, &fields) {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid prefs", "code": errorCode(http.StatusBadRequest), "fields": fields})
+}
+
+// prefsSchema is the JSON Schema served at GET /prefs/schema. Keep it in
+// step with Prefs and validatePrefs.
+func prefsSchema() map[string]any {
+	color := map[string]any{"type": "string", "pattern": "^#?[0-9A-Fa-f]{6}$|^$", "description": "#RRGGBB; empty = the effect's default"}
+	cycles := map[string]any{"type": "integer", "minimum": 0, "maximum": maxCycles}
+	event := map[string]any{
+		"type":     "object",
+		"required": []string{"effect"},
+		"properties": map[string]any{
+			"effect":     map[string]any{"type": "string", "description": "effect name from the device's hello (unknown names fall back to the celebrate blink), or \"random\" to pick from effects"},
+			"effects":    map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "pool for effect \"random\"; empty = every show effect the device has (not count, countdown, nudge, scroll_text, stack or testpattern)"},
+			"color":      color,
+			"colors":     map[string]any{"type": "array", "items": color, "description": "optional; palette effects (stacked shoot) use them all, others get one picked per event; a named palette wins"},
+			"cycles":     cycles,
+			"brightness": map[string]any{"type": "integer", "minimum": 0, "maximum": 255},
+			"palette":    map[string]any{"type": "string", "description": "named palette, e.g. team, christmas, usa, pride"},
+			"text":       map[string]any{"type": "string", "description": "scroll_text banner"},
+			"resumeIdle": map[string]any{"type": "boolean", "default": true},
+			"fadeCurve":  map[string]any{"enum": []string{"", "linear", "exp", "exponential", "gamma"}},
+			"headGlow":   map[string]any{"type": "number", "minimum": 0, "maximum": 1},
+			"mirror":     map[string]any{"type": "boolean"},
+			"cooldownMs": map[string]any{"type": "integer", "minimum": 0, "maximum": maxCooldownMs, "description": "repeats within this many ms are dropped on the device"},
+		},
+	}
+	override := maps.Clone(event)
+	override["required"] = []string{"effect", "expiresAt"}
+	override["properties"] = maps.Clone(event["properties"].(map[string]any))
+	override["properties"].(map[string]any)["expiresAt"] = map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339 instant the override stops applying; write it in UTC"}
+	event["properties"].(map[string]any)["override"] = override
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "Device prefs",
+		"type":    "object",
+		"properties": map[string]any{
+			"idle": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"effect":    map[string]any{"enum": append([]string{""}, prefs.IdleEffects...)},
+					"color":     color,
+					"cycles":    cycles,
+					"colorB":    color,
+					"kelvin":    map[string]any{"type": "integer", "anyOf": []any{map[string]any{"const": 0}, map[string]any{"minimum": 2000, "maximum": 6500}}},
+					"bpm":       map[string]any{"type": "integer", "minimum": 0, "description": "clamped to 20..150 on the device"},
+					"periodSec": map[string]any{"type": "integer", "anyOf": []any{map[string]any{"const": 0}, map[string]any{"minimum": minHueDriftSec, "maximum": maxHueDriftSec}}, "description": "huedrift: seconds per hue rotation, 0 = 300"},
+					"density":   map[string]any{"type": "number", "minimum": 0, "maximum": 1, "description": "gradienttwinkle: share of LEDs sparkling per second, 0 = 0.05"},
+					"palette":   map[string]any{"type": "string", "description": "palettecycle: named palette, \"\" = the default"},
+					"blend":     map[string]any{"type": "boolean", "description": "palettecycle: crossfade between colors"},
+					"stepMs":    map[string]any{"type": "integer", "anyOf": []any{map[string]any{"const": 0}, map[string]any{"minimum": minPaletteStepMs, "maximum": maxPaletteStepMs}}, "description": "palettecycle: time on each color, 0 = 2000"},
+				},
+			},
+			"events":            map[string]any{"type": "object", "additionalProperties": event},
+			"accessiblePalette": map[string]any{"type": "boolean"},
+			"locked":            map[string]any{"type": "boolean", "description": "ignore effect/color/palette overrides from broadcasts"},
+		},
+	}
+}
+
+func handlePrefsSchema(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, _ = w.Write(mustJSON(prefsSchema()))
+}
+
+func validBrightness(b *int) error {
+	if b != nil && (*b < 0 || *b > 255) {
+		return errors.New("must be 0..255")
+	}
+	return nil
+}
 func mustJSON(v any) []byte { b, _ := json.MarshalIndent(v, "", "  "); return b }
 
 // ---------- HTTP: register & prefs ----------
@@ -259,7 +950,7 @@ func mustJSON(v any) []byte { b, _ := json.MarshalIndent(v, "", "  "); return b
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req RegisterReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
+		writeError(w, "bad json", http.StatusBadRequest)
 		return
 	}
 
@@ -272,115 +963,292 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	devMu.Lock()
 	if _, exists := devices[id]; exists {
 		devMu.Unlock()
-		http.Error(w, "device exists", http.StatusConflict)
+		writeError(w, "device exists", http.StatusConflict)
 		return
 	}
-	devices[id] = Device{ID: id, Secret: secret, Label: req.Label}
+	devices[id] = Device{ID: id, Secret: secret, Label: req.Label, Group: strings.TrimSpace(req.Group)}
 	devMu.Unlock()
 
 	if err := saveDevices(); err != nil {
-		http.Error(w, "save devices: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, "save devices: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	writeJSON(w, RegisterResp{DeviceID: id, DeviceSecret: secret})
+	resp := RegisterResp{DeviceID: id, DeviceSecret: secret}
+	if r.URL.Query().Get("format") == "clientjson" {
+		// same fields as the client's ClientIdent: curl ... > client.json
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="client.json"`)
+		_, _ = w.Write(append(mustJSON(resp), '\n'))
+		return
+	}
+	writeJSON(w, resp)
 }
 
 func handleGetPrefs(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if !deviceExists(id) {
-		http.Error(w, "unknown device", http.StatusNotFound)
+		writeError(w, "unknown device", http.StatusNotFound)
 		return
 	}
 	p, err := readPrefs(id)
+	if err == nil && hasExpiredOverrides(p) {
+		p, err = sweepOverrides(id)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", prefsETag(p))
 	writeJSON(w, p)
 }
 
+func hasExpiredOverrides(p prefs.Prefs) bool {
+	now := time.Now()
+	for _, ev := range p.Events {
+		if ev.OverrideExpired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepOverrides drops expired event overrides from a device's stored
+// prefs, so they stop showing up in reads. Clients check expiry on their
+// own as well, so a device that doesn't refetch still reverts on time.
+func sweepOverrides(id string) (prefs.Prefs, error) {
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	p, err := readPrefs(id)
+	if err != nil {
+		return p, err
+	}
+	now := time.Now()
+	for name, ev := range p.Events {
+		if ev.OverrideExpired(now) {
+			log.Printf("prefs %s: override of %s expired at %s; removed", id, name, ev.Override.ExpiresAt.UTC().Format(time.RFC3339))
+			ev.Override = nil
+			p.Events[name] = ev
+		}
+	}
+	return p, writePrefs(id, p)
+}
+
+// prefsETag versions a prefs document by content. PUT, PATCH and bulk
+// writes honor If-Match against it; without If-Match the last writer
+// still wins.
+func prefsETag(p prefs.Prefs) string {
+	sum := sha256.Sum256(mustJSON(p))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// checkIfMatch must be called with prefsMu held. It writes 412 and returns
+// false when the stored prefs no longer match the client's If-Match.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, cur prefs.Prefs) bool {
+	if ifMatch(r, cur) {
+		return true
+	}
+	w.Header().Set("ETag", prefsETag(cur))
+	writeError(w, errPrefsChanged.Error(), http.StatusPreconditionFailed)
+	return false
+}
+
+var errPrefsChanged = errors.New("prefs changed since they were read")
+
+// ifMatch reports whether cur satisfies the request's If-Match (true when
+// it has none).
+func ifMatch(r *http.Request, cur prefs.Prefs) bool {
+	want := strings.TrimSpace(r.Header.Get("If-Match"))
+	if want == "" || want == "*" {
+		return true
+	}
+	etag := prefsETag(cur)
+	for _, t := range strings.Split(want, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func handlePutPrefs(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if !deviceExists(id) {
-		http.Error(w, "unknown device", http.StatusNotFound)
+		writeError(w, "unknown device", http.StatusNotFound)
 		return
 	}
-	var p Prefs
+	var p prefs.Prefs
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
+		writeError(w, "bad json", http.StatusBadRequest)
 		return
 	}
-	if err := writePrefs(id, p); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validatePrefs(p); err != nil {
+		writePrefsError(w, err)
 		return
 	}
-	writeJSON(w, map[string]string{"status": "ok"})
-}
-
-// ---------- WebSocket (HMAC auth) ----------
-
-func handleWS(w http.ResponseWriter, r *http.Request) {
-	devID, ts, sig := r.Header.Get("X-Device-ID"), r.Header.Get("X-Auth-Ts"), r.Header.Get("X-Auth-Sig")
-	if devID == "" || ts == "" || sig == "" {
-		http.Error(w, "missing auth headers", http.StatusUnauthorized)
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	cur, err := readPrefs(id)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !deviceExists(devID) {
-		http.Error(w, "unknown device", http.StatusUnauthorized)
+	if !checkIfMatch(w, r, cur) {
 		return
 	}
-	sec := deviceSecret(devID)
-	if sec == "" {
-		http.Error(w, "no secret", http.StatusUnauthorized)
+	if err := writePrefs(id, p); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", prefsETag(p))
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// PATCH takes a JSON merge patch (RFC 7386): omitted fields are kept, null
+// removes a key (e.g. {"events":{"old_event":null}}).
+func handlePatchPrefs(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !deviceExists(id) {
+		writeError(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	var patch map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, "bad json", http.StatusBadRequest)
+		return
+	}
+
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	cur, err := readPrefs(id)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkIfMatch(w, r, cur) {
+		return
+	}
+	var doc map[string]any
+	_ = json.Unmarshal(mustJSON(cur), &doc)
+	var p prefs.Prefs
+	if err := json.Unmarshal(mustJSON(mergePatch(doc, patch)), &p); err != nil {
+		writeError(w, "bad prefs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Events == nil {
+		p.Events = map[string]prefs.Event{}
+	}
+	if err := validatePrefs(p); err != nil {
+		writePrefsError(w, err)
+		return
+	}
+	if err := writePrefs(id, p); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", prefsETag(p))
+	writeJSON(w, p)
+}
+
+func mergePatch(doc, patch map[string]any) map[string]any {
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(doc, k)
+		case map[string]any:
+			sub, _ := doc[k].(map[string]any)
+			doc[k] = mergePatch(sub, v)
+		default:
+			doc[k] = v
+		}
+	}
+	return doc
+}
+
+// ---------- WebSocket (HMAC auth) ----------
+
+func handleWS(w http.ResponseWriter, r *http.Request) {
+	if !wsAllowLegacy && !slices.Contains(websocket.Subprotocols(r), wsSubprotocol) {
+		writeError(w, "websocket subprotocol "+wsSubprotocol+" required", http.StatusBadRequest)
+		return
+	}
+	devID, ts, sig := r.Header.Get("X-Device-ID"), r.Header.Get("X-Auth-Ts"), r.Header.Get("X-Auth-Sig")
+	if devID == "" || ts == "" || sig == "" {
+		writeError(w, "missing auth headers", http.StatusUnauthorized)
+		return
+	}
+	if !deviceExists(devID) {
+		writeError(w, "unknown device", http.StatusUnauthorized)
+		return
+	}
+	sec := deviceSecret(devID)
+	if sec == "" {
+		writeError(w, "no secret", http.StatusUnauthorized)
 		return
 	}
 
 	tUnix, err := strconv.ParseInt(ts, 10, 64)
 	if err != nil || abs(time.Now().Unix()-tUnix) > 300 {
-		http.Error(w, "timestamp skew", http.StatusUnauthorized)
+		writeError(w, "timestamp skew", http.StatusUnauthorized)
 		return
 	}
 	want := makeSig(devID, sec, ts)
 	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(want)) {
-		http.Error(w, "bad signature", http.StatusUnauthorized)
+		writeError(w, "bad signature", http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	conn := &wsConn{Conn: ws, opened: time.Now()}
+	conn.SetReadLimit(maxClientMessage)
+	label, proto := deviceLabel(devID), ws.Subprotocol()
 	addConn(devID, conn)
-	defer removeConn(devID, conn)
+	touchDevice(devID)
+	log.Printf("WS connected: %s (%q) protocol=%q", devID, label, proto)
+	defer func() {
+		removeConn(devID, conn)
+		log.Printf("WS disconnected: %s (%q)", devID, label)
+	}()
 
 	// ---- Keepalive: deadlines + ping/pong handlers
-	const ka = 90 * time.Second
+	// Only answers to OUR pings (and real messages) count as liveness. A
+	// wedged client whose read loop is stuck stops answering pings even if
+	// its own ping ticker keeps running, so its socket gets dropped once the
+	// read deadline passes instead of lingering as "connected".
+	ka, pingEvery := wsReadTimeout, wsPingInterval
+	const writeWait = 5 * time.Second
 	_ = conn.SetReadDeadline(time.Now().Add(ka))
 
 	conn.SetPongHandler(func(string) error {
-		// Got a Pong (likely in response to our Ping) → extend deadline
+		// Got a Pong (in response to our Ping) → extend deadline
+		touchDevice(devID)
 		return conn.SetReadDeadline(time.Now().Add(ka))
 	})
 	conn.SetPingHandler(func(appData string) error {
-		// Client pinged us → extend deadline and reply Pong
-		if err := conn.SetReadDeadline(time.Now().Add(ka)); err != nil {
-			return err
-		}
-		deadline := time.Now().Add(5 * time.Second)
-		return conn.WriteControl(websocket.PongMessage, []byte(appData), deadline)
+		// Client pinged us → reply Pong (doesn't prove its read loop is alive)
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeWait))
 	})
 
 	// Periodically ping the client so we get Pongs and keep the proxy happy
 	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		t := time.NewTicker(25 * time.Second)
+		t := time.NewTicker(pingEvery)
 		defer t.Stop()
 		for {
 			select {
 			case <-t.C:
-				deadline := time.Now().Add(5 * time.Second)
-				_ = conn.WriteControl(websocket.PingMessage, []byte("ping"), deadline)
+				if err := conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(writeWait)); err != nil {
+					log.Printf("WS ping %s failed: %v; dropping", devID, err)
+					_ = conn.Close() // unblocks the read loop below
+					return
+				}
 			case <-done:
 				return
 			}
@@ -389,11 +1257,96 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 
 	// Read loop (must keep reading so control frames are processed)
 	for {
-		if _, _, err := conn.ReadMessage(); err != nil {
-			close(done)
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			var ne net.Error
+			switch {
+			case errors.As(err, &ne) && ne.Timeout():
+				log.Printf("WS %s: no pong within %s; dropping", devID, ka)
+			case errors.Is(err, websocket.ErrReadLimit):
+				// gorilla has already sent the 1009 close
+				log.Printf("WS %s: message over %d bytes; dropping", devID, maxClientMessage)
+			}
 			return
 		}
+		touchDevice(devID)
+		_ = conn.SetReadDeadline(time.Now().Add(ka))
+		if mt != websocket.TextMessage {
+			log.Printf("WS %s: binary message; dropping", devID)
+			conn.closeWith(websocket.CloseUnsupportedData, "text messages only")
+			return
+		}
+		if err := handleClientMessage(devID, proto, data); err != nil {
+			log.Printf("WS %s: malformed message (%v); dropping", devID, err)
+			conn.closeWith(websocket.CloseInvalidFramePayloadData, "malformed message")
+			return
+		}
+	}
+}
+
+func envelope(typ string, payload any) []byte {
+	e := Envelope{V: protoVersion, Type: typ}
+	if payload != nil {
+		e.Payload = mustJSON(payload)
+	}
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// maxClientMessage bounds one message from a device; hellos and acks are
+// small. Anything bigger gets a 1009 close and ends the socket.
+const maxClientMessage = 64 << 10
+
+// handleClientMessage routes one text message from a device: "hello" is
+// recorded, "frame_snapshot" is kept for handleDeviceFrame, "ack" and
+// "pong" only prove liveness (the read loop has already counted that), and
+// other types are logged and ignored so newer
+// clients can add some. An error means the message was malformed and the
+// socket should go.
+func handleClientMessage(devID, proto string, data []byte) error {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return fmt.Errorf("not a JSON object: %w", err)
+	}
+	switch e.Type {
+	case "hello":
+	case "ack", "pong":
+		return nil
+	case "frame_snapshot":
+		var f FrameSnapshot
+		if err := json.Unmarshal(e.Payload, &f); err != nil {
+			return fmt.Errorf("frame_snapshot: %w", err)
+		}
+		if len(f.Leds) != 6*f.LedCount {
+			return fmt.Errorf("frame_snapshot: %d hex chars for %d LEDs", len(f.Leds), f.LedCount)
+		}
+		if _, err := hex.DecodeString(f.Leds); err != nil {
+			return fmt.Errorf("frame_snapshot: %w", err)
+		}
+		statsMu.Lock()
+		st := deviceStatsFor(devID)
+		st.frame, st.frameAt = &f, time.Now()
+		statsMu.Unlock()
+		return nil
+	default:
+		log.Printf("WS %s: ignoring client message type %q", devID, e.Type)
+		return nil
+	}
+
+	hello := e.Payload
+	if e.V == 0 {
+		hello = data // pre-envelope clients send the hello fields at the top level
+	}
+	var h Hello
+	if err := json.Unmarshal(hello, &h); err != nil {
+		return fmt.Errorf("hello: %w", err)
 	}
+	h.Type, h.Protocol = "", proto
+	statsMu.Lock()
+	deviceStatsFor(devID).hello = &h
+	statsMu.Unlock()
+	log.Printf("Hello from %s: version=%s protocol=%q ledCount=%d effects=%v", devID, h.Version, proto, h.LedCount, h.Effects)
+	return nil
 }
 
 func makeSig(id, secret, ts string) string {
@@ -409,15 +1362,115 @@ func abs(x int64) int64 {
 	}
 	return x
 }
-func addConn(id string, c *websocket.Conn) {
+
+// wsConn is one device socket. gorilla allows only one writer at a time,
+// so data writes go through send; pings use WriteControl, which is safe
+// alongside it.
+type wsConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+	opened  time.Time
+}
+
+// wsWriteTimeout bounds one write; a device that can't take a message in
+// that long is dropped.
+const wsWriteTimeout = 5 * time.Second
+
+func (c *wsConn) send(msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.WriteMessage(websocket.TextMessage, msg)
+}
+
+// closeWith sends a close frame with code and reason, then closes.
+func (c *wsConn) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = c.Close()
+}
+
+// deviceConn is one socket of one device, as snapshotted for a fan-out.
+type deviceConn struct {
+	id string
+	c  *wsConn
+}
+
+// connsFor snapshots the sockets of device id ("" = every device).
+func connsFor(id string) []deviceConn {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	var out []deviceConn
+	for devID, set := range wsByDevice {
+		if id != "" && devID != id {
+			continue
+		}
+		for c := range set {
+			out = append(out, deviceConn{devID, c})
+		}
+	}
+	return out
+}
+
+// fanOutWorkers caps how many socket writes one fan-out has in flight.
+const fanOutWorkers = 16
+
+// fanOut writes msg to conns concurrently, outside wsMu, so one stuck
+// device can't hold up the rest. Sockets whose write fails or times out
+// are removed and counted in the device's writeErrors. It returns how many
+// writes succeeded and the devices that got at least one.
+func fanOut(conns []deviceConn, msg []byte) (int, map[string]bool) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sent    int
+		reached = map[string]bool{}
+		sem     = make(chan struct{}, fanOutWorkers)
+	)
+	for _, dc := range conns {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := dc.c.send(msg); err != nil {
+				log.Printf("WS write to %s failed: %v; dropping", dc.id, err)
+				removeConn(dc.id, dc.c)
+				statsMu.Lock()
+				deviceStatsFor(dc.id).writeErrors++
+				statsMu.Unlock()
+				return
+			}
+			mu.Lock()
+			sent++
+			reached[dc.id] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return sent, reached
+}
+
+func addConn(id string, c *wsConn) {
 	wsMu.Lock()
 	defer wsMu.Unlock()
 	if wsByDevice[id] == nil {
-		wsByDevice[id] = map[*websocket.Conn]struct{}{}
+		wsByDevice[id] = map[*wsConn]struct{}{}
 	}
-	wsByDevice[id][c] = struct{}{}
+	set := wsByDevice[id]
+	for len(set) >= maxConnsPerDevice {
+		var oldest *wsConn
+		for o := range set {
+			if oldest == nil || o.opened.Before(oldest.opened) {
+				oldest = o
+			}
+		}
+		delete(set, oldest)
+		_ = oldest.Close() // its read loop ends and runs removeConn, a no-op now
+		log.Printf("WS %s: over %d connections, closed the oldest (from %s)", id, maxConnsPerDevice, oldest.opened.Format(time.RFC3339))
+	}
+	set[c] = struct{}{}
 }
-func removeConn(id string, c *websocket.Conn) {
+func removeConn(id string, c *wsConn) {
 	wsMu.Lock()
 	defer wsMu.Unlock()
 	if set := wsByDevice[id]; set != nil {
@@ -428,55 +1481,848 @@ func removeConn(id string, c *websocket.Conn) {
 	}
 	_ = c.Close()
 }
+func isConnected(id string) bool {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	return len(wsByDevice[id]) > 0
+}
+
+// ---------- Device status ----------
+
+func deviceStatsFor(id string) *deviceStats {
+	st := stats[id]
+	if st == nil {
+		st = &deviceStats{}
+		stats[id] = st
+	}
+	return st
+}
+func touchDevice(id string) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	deviceStatsFor(id).lastSeen = time.Now()
+}
+func countEffect(id string) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	deviceStatsFor(id).effects++
+}
+
+// ---------- health ----------
+
+// devicesLoadErr is why devices.json couldn't be read at startup; health
+// checks report 503 while it's set.
+var devicesLoadErr error
+
+// checkDataDir proves dataDir is writable by creating and removing a file.
+func checkDataDir() error {
+	f, err := os.CreateTemp(dataDir, ".healthz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
+
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	if devicesLoadErr != nil || checkDataDir() != nil {
+		writeError(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// handleVersion reports which build is running (unauthenticated), e.g. to
+// confirm a redeploy picked up the new binary.
+func handleVersion(w http.ResponseWriter, _ *http.Request) {
+	c, t := commit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, kv := range info.Settings {
+			switch {
+			case kv.Key == "vcs.revision" && c == "":
+				c = kv.Value
+			case kv.Key == "vcs.time" && t == "":
+				t = kv.Value
+			}
+		}
+	}
+	writeJSON(w, map[string]string{
+		"version":   version,
+		"commit":    c,
+		"buildTime": t,
+		"goVersion": runtime.Version(),
+	})
+}
+
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	resp := map[string]any{"status": "ok"}
+	code := http.StatusOK
+	fail := func(key string, err error) {
+		resp[key] = err.Error()
+		resp["status"] = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	if devicesLoadErr != nil {
+		fail("devicesError", devicesLoadErr)
+	}
+	if err := checkDataDir(); err != nil {
+		fail("dataDirError", err)
+	}
+
+	devMu.RLock()
+	resp["devices"] = len(devices)
+	devMu.RUnlock()
+	sockets := 0
+	wsMu.Lock()
+	for _, set := range wsByDevice {
+		sockets += len(set)
+	}
+	wsMu.Unlock()
+	resp["sockets"] = sockets
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func handleListDevices(w http.ResponseWriter, _ *http.Request) {
+	devMu.RLock()
+	list := make([]DeviceInfo, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, DeviceInfo{ID: d.ID, Label: d.Label, Group: d.Group})
+	}
+	devMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	for i := range list {
+		list[i].Connected = isConnected(list[i].ID)
+	}
+	statsMu.Lock()
+	for i := range list {
+		if ds := stats[list[i].ID]; ds != nil {
+			list[i].Hello = ds.hello
+			if !ds.lastSeen.IsZero() {
+				seen := ds.lastSeen.UTC()
+				list[i].LastSeen = &seen
+			}
+		}
+	}
+	statsMu.Unlock()
+	writeJSON(w, list)
+}
+
+func handleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !deviceExists(id) {
+		writeError(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	st := DeviceStatus{Connected: isConnected(id)}
+	statsMu.Lock()
+	if ds := stats[id]; ds != nil {
+		st.EffectCount = ds.effects
+		st.WriteErrors = ds.writeErrors
+		if !ds.lastSeen.IsZero() {
+			seen := ds.lastSeen.UTC()
+			st.LastSeen = &seen
+		}
+	}
+	statsMu.Unlock()
+	writeJSON(w, st)
+}
+
+// ---------- Preview (PNG, no hardware) ----------
+
+type PreviewReq struct {
+	Effect   string `json:"effect"`
+	Color    string `json:"color"`
+	Cycles   int    `json:"cycles"`
+	LedCount int    `json:"ledCount"`
+}
+
+const (
+	maxPreviewLeds   = 2000
+	maxPreviewFrames = 2000
+)
+
+// handlePreview renders an effect with the same generators the client
+// plays, one PNG row per frame (capped at maxPreviewFrames rows).
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	var req PreviewReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	n := req.LedCount
+	if n <= 0 {
+		n = 300
+	}
+	if n > maxPreviewLeds {
+		writeError(w, "ledCount too large", http.StatusBadRequest)
+		return
+	}
+	color, err := parseColor(req.Color)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seq, ok := frames.ByName(strings.ToLower(strings.TrimSpace(req.Effect)), color, req.Cycles, n)
+	if !ok {
+		writeError(w, "unknown effect", http.StatusBadRequest)
+		return
+	}
+
+	var rows [][]uint32
+	for buf := range seq {
+		rows = append(rows, append([]uint32(nil), buf...))
+		if len(rows) >= maxPreviewFrames {
+			break
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, n, max(len(rows), 1)))
+	for y, row := range rows {
+		for x, c := range row {
+			img.Set(x, y, stdcolor.RGBA{R: uint8(c >> 16), G: uint8(c >> 8), B: uint8(c), A: 0xFF})
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_ = png.Encode(w, img)
+}
+
+// parseColor parses "#RRGGBB" or "RRGGBB"; empty means the client default green.
+func parseColor(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if s == "" {
+		return 0x00FF00, nil
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return 0, errors.New("color must be #RRGGBB")
+	}
+	return uint32(v), nil
+}
+
+// ---------- Event History (history.jsonl) ----------
+
+// HistoryEntry is one line of history.jsonl: a broadcast and who got it.
+type HistoryEntry struct {
+	Time    time.Time `json:"ts"`
+	Target  string    `json:"target,omitempty"` // requested device; "" = everyone
+	Devices []string  `json:"devices"`          // devices actually reached
+	Event   string    `json:"event"`
+	Effect  string    `json:"effect,omitempty"`
+	Count   int       `json:"count"` // connections written to
+}
+
+var (
+	historyFile = filepath.Join(dataDir, "history.jsonl")
+	// Past HISTORY_MAX_BYTES (default 1MB) the oldest half is dropped.
+	historyMaxBytes = int64(envInt("HISTORY_MAX_BYTES", 1<<20))
+	historyMu       sync.Mutex
+)
+
+func envInt(k string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(k)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+func recordHistory(e HistoryEntry) {
+	e.Time = time.Now().UTC()
+	if e.Devices == nil {
+		e.Devices = []string{}
+	}
+	line, _ := json.Marshal(e)
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	f, err := os.OpenFile(historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	_, err = f.Write(append(line, '\n'))
+	st, _ := f.Stat()
+	_ = f.Close()
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	if st != nil && st.Size() > historyMaxBytes {
+		trimHistory()
+	}
+}
+
+// trimHistory keeps the newest half of the file (historyMu held).
+func trimHistory() {
+	b, err := os.ReadFile(historyFile)
+	if err != nil {
+		return
+	}
+	cut := len(b) / 2
+	if i := bytes.IndexByte(b[cut:], '\n'); i >= 0 {
+		cut += i + 1
+	}
+	tmp := historyFile + ".tmp"
+	if err := os.WriteFile(tmp, b[cut:], 0o644); err != nil {
+		log.Printf("history trim: %v", err)
+		return
+	}
+	_ = os.Rename(tmp, historyFile)
+}
+
+// readHistory returns up to limit of the newest entries involving id,
+// newest first.
+func readHistory(id string, limit int) ([]HistoryEntry, error) {
+	historyMu.Lock()
+	b, err := os.ReadFile(historyFile)
+	historyMu.Unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []HistoryEntry{}, nil
+		}
+		return nil, err
+	}
+	out := []HistoryEntry{}
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	for i := len(lines) - 1; i >= 0 && len(out) < limit; i-- {
+		var e HistoryEntry
+		if json.Unmarshal(lines[i], &e) != nil {
+			continue
+		}
+		if e.Target == id || slices.Contains(e.Devices, id) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func handleDeviceHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !deviceExists(id) {
+		writeError(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, "limit must be 1..1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	entries, err := readHistory(id, limit)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
 
 // ---------- Broadcast & Config Notify ----------
 
+// Idempotency keys seen recently (CRM webhook retries). In memory only, so
+// a restart forgets them; the TTL is IDEMPOTENCY_TTL (default 10m).
+var (
+	idempotencyTTL = envDuration("IDEMPOTENCY_TTL", 10*time.Minute)
+	idemMu         sync.Mutex
+	idemSeen       = map[string]time.Time{}
+)
+
+// seenIdempotencyKey records key and reports whether it was already seen
+// within the TTL.
+func seenIdempotencyKey(key string) bool {
+	idemMu.Lock()
+	defer idemMu.Unlock()
+	now := time.Now()
+	for k, t := range idemSeen {
+		if now.Sub(t) > idempotencyTTL {
+			delete(idemSeen, k)
+		}
+	}
+	if _, ok := idemSeen[key]; ok {
+		return true
+	}
+	idemSeen[key] = now
+	return false
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 func handleTestBroadcast(w http.ResponseWriter, r *http.Request) {
 	var b Broadcast
 	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
+		writeError(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	broadcast(w, r, b)
+}
+
+// ownEnvelope reports whether a broadcast type goes out as its own envelope
+// type rather than as an "event" that plays an effect.
+func ownEnvelope(typ string) bool {
+	switch typ {
+	case "config_updated", "frame", "off", "on", "resume_idle", "set_idle", "count", "stack_reset":
+		return true
+	}
+	return false
+}
+
+// Synchronized starts: a broadcast's startAt is a wall-clock time, so
+// strips only fire together if their clocks agree. Devices are assumed to
+// be NTP-synced to within a few tens of milliseconds; one that is off by
+// seconds fires early or late by that much. startAt may be at most
+// maxStartAhead away, and the wave endpoint leaves waveLead for delivery.
+const (
+	maxStartAhead = time.Minute
+	waveLead      = 2 * time.Second
+)
+
+// maxCountdownMs bounds a "countdown" broadcast's durationMs (one hour).
+const maxCountdownMs = 60 * 60 * 1000
+
+// handleWave sends one effect to every device (less any excluded) with a
+// shared startAt, so all strips fire at the same moment. Without a startAt
+// it uses now + waveLead.
+func handleWave(w http.ResponseWriter, r *http.Request) {
+	var b Broadcast
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		writeError(w, "bad json", http.StatusBadRequest)
 		return
 	}
+	if b.DeviceID != "" || b.Label != "" {
+		writeError(w, "a wave goes to every device; use excludeDeviceIds to skip some", http.StatusBadRequest)
+		return
+	}
+	if b.StartAt == 0 {
+		b.StartAt = time.Now().Add(waveLead).UnixMilli()
+	}
+	broadcast(w, r, b)
+}
+
+// broadcast validates b and sends it to its target devices (all of them
+// when it has none), answering with how many sockets got it.
+func broadcast(w http.ResponseWriter, r *http.Request, b Broadcast) {
 	if b.Type == "" && b.Effect == "" {
-		http.Error(w, "need type or effect", http.StatusBadRequest)
+		writeError(w, "need type or effect", http.StatusBadRequest)
+		return
+	}
+	if err := validBrightness(b.Brightness); err != nil {
+		writeError(w, "brightness: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validCycles(b.Cycles); err != nil {
+		writeError(w, "cycles: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := frames.ParseCurve(b.FadeCurve); !ok {
+		writeError(w, "fadeCurve: must be linear, exp or gamma", http.StatusBadRequest)
+		return
+	}
+	if b.HeadGlow < 0 || b.HeadGlow > 1 {
+		writeError(w, "headGlow: must be 0..1", http.StatusBadRequest)
+		return
+	}
+	if b.Intensity != nil && (*b.Intensity < 0 || *b.Intensity > 1) {
+		writeError(w, "intensity: must be 0..1", http.StatusBadRequest)
+		return
+	}
+	if b.DurationMs < 0 || b.DurationMs > maxCountdownMs {
+		writeError(w, fmt.Sprintf("durationMs: must be 0..%d", maxCountdownMs), http.StatusBadRequest)
+		return
+	}
+	if b.StartAt != 0 {
+		at := time.UnixMilli(b.StartAt)
+		if at.Before(time.Now()) || time.Until(at) > maxStartAhead {
+			writeError(w, fmt.Sprintf("startAt: must be unix millis within the next %s", maxStartAhead), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if b.Label != "" {
+		id, status, err := deviceByLabel(b.Label)
+		if err != nil {
+			writeError(w, err.Error(), status)
+			return
+		}
+		if b.DeviceID != "" && b.DeviceID != id {
+			writeError(w, fmt.Sprintf("label %q is %s, not %s", b.Label, id, b.DeviceID), http.StatusBadRequest)
+			return
+		}
+		b.DeviceID, b.Label = id, ""
+	}
+	if b.DeviceID != "" && len(b.ExcludeDeviceIDs) > 0 {
+		writeError(w, "excludeDeviceIds only applies to all-device broadcasts", http.StatusBadRequest)
 		return
 	}
+	exclude := b.ExcludeDeviceIDs
+	b.ExcludeDeviceIDs = nil
 
-	payload, _ := json.Marshal(b)
+	// a targeted override of a locked device's look is refused outright;
+	// all-device broadcasts still go out and the device ignores the override
+	if b.DeviceID != "" && (b.Effect != "" || b.Color != "" || b.Palette != "") && !ownEnvelope(b.Type) {
+		if p, err := readPrefs(b.DeviceID); err == nil && p.Locked {
+			writeError(w, "device is locked: its effect, color and palette come from its own prefs", http.StatusConflict)
+			return
+		}
+	}
 
-	sent := 0
-	wsMu.Lock()
-	if b.DeviceID != "" {
-		if set := wsByDevice[b.DeviceID]; set != nil {
-			for c := range set {
-				_ = c.WriteMessage(websocket.TextMessage, payload)
-				sent++
+	idemKey := firstNonEmpty(b.IdempotencyKey, r.Header.Get("Idempotency-Key"))
+	b.IdempotencyKey = ""
+
+	payload := envelope("event", b)
+	switch b.Type {
+	case "config_updated":
+		payload = envelope("config_updated", nil)
+	case "off", "on", "resume_idle", "stack_reset":
+		// own envelope types, so clients that don't know them ignore them;
+		// resume_idle is an alias for on, stack_reset clears the stack bar
+		if b.Type == "resume_idle" {
+			b.Type = "on"
+		}
+		payload = envelope(b.Type, nil)
+	case "set_idle":
+		// switches the idle directly; the next prefs fetch still overrides it
+		effect := strings.ToLower(strings.TrimSpace(b.Effect))
+		if !slices.Contains(prefs.IdleEffects, effect) {
+			writeError(w, "set_idle: effect must be one of "+strings.Join(prefs.IdleEffects, ", "), http.StatusBadRequest)
+			return
+		}
+		if b.Color != "" {
+			if _, err := parseColor(b.Color); err != nil {
+				writeError(w, "set_idle: "+err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
-	} else {
-		for _, set := range wsByDevice {
-			for c := range set {
-				_ = c.WriteMessage(websocket.TextMessage, payload)
+		payload = envelope("set_idle", map[string]string{"effect": effect, "color": b.Color})
+	case "count":
+		if b.Value == nil || *b.Value < 0 {
+			writeError(w, "count: need value >= 0", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseColor(b.Color); err != nil {
+			writeError(w, "count: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload = envelope("count", map[string]any{"value": *b.Value, "color": b.Color})
+	case "frame":
+		raw, err := base64.StdEncoding.DecodeString(b.Frame)
+		if err != nil || len(raw) == 0 || len(raw)%4 != 0 || len(raw)/4 > maxFrameLeds {
+			writeError(w, fmt.Sprintf("frame: need base64 of 1..%d big-endian uint32s", maxFrameLeds), http.StatusBadRequest)
+			return
+		}
+		payload = envelope("frame", map[string]string{"frame": b.Frame})
+	}
+
+	if idemKey != "" && seenIdempotencyKey(idemKey) {
+		log.Printf("broadcast: duplicate idempotency key %q suppressed", idemKey)
+		writeJSON(w, map[string]any{"status": "duplicate", "count": 0, "labels": []string{}})
+		return
+	}
+
+	conns := connsFor(b.DeviceID)
+	if len(exclude) > 0 {
+		conns = slices.DeleteFunc(conns, func(c deviceConn) bool { return slices.Contains(exclude, c.id) })
+	}
+	sent, reached := fanOut(conns, payload)
+	if fakeDevices {
+		targets := []string{b.DeviceID}
+		if b.DeviceID == "" {
+			targets = slices.DeleteFunc(registeredDevices(), func(id string) bool { return slices.Contains(exclude, id) })
+		}
+		for _, id := range targets {
+			if !reached[id] {
+				log.Printf("fake devices: would send to %s: %s", id, payload)
 				sent++
+				reached[id] = true
 			}
 		}
 	}
-	wsMu.Unlock()
 
-	writeJSON(w, map[string]any{"status": "sent", "count": sent})
+	labels := make([]string, 0, len(reached))
+	for id := range reached {
+		labels = append(labels, firstNonEmpty(deviceLabel(id), id))
+		if !ownEnvelope(b.Type) {
+			countEffect(id)
+		}
+	}
+	sort.Strings(labels)
+
+	if b.Type != "frame" { // raw frames stream far too fast to log
+		recordHistory(HistoryEntry{
+			Target: b.DeviceID, Devices: slices.Sorted(maps.Keys(reached)),
+			Event: b.Type, Effect: b.Effect, Count: sent,
+		})
+	}
+	resp := map[string]any{"status": "sent", "count": sent, "labels": labels}
+	if fakeDevices {
+		resp["fake"] = true
+	}
+	if b.StartAt != 0 {
+		resp["startAt"] = b.StartAt
+	}
+	writeJSON(w, resp)
 }
 
-func handleNotifyConfig(w http.ResponseWriter, r *http.Request) {
+// TestReq fires one effect at one device without touching its prefs.
+type TestReq struct {
+	Effect     string `json:"effect"`
+	Color      string `json:"color"`
+	Cycles     int    `json:"cycles"`
+	Brightness *int   `json:"brightness,omitempty"`
+	Palette    string `json:"palette,omitempty"`
+}
+
+func handleDeviceTest(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	msg := []byte(`{"type":"config_updated"}`)
-	n := 0
-	wsMu.Lock()
-	if set := wsByDevice[id]; set != nil {
-		for c := range set {
-			_ = c.WriteMessage(websocket.TextMessage, msg)
-			n++
+	if !deviceExists(id) {
+		writeError(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	var t TestReq
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	t.Effect = strings.ToLower(strings.TrimSpace(t.Effect))
+	if t.Effect == "" {
+		writeError(w, "need effect", http.StatusBadRequest)
+		return
+	}
+	// the device's hello says which effects it can run; trust it if we have one
+	statsMu.Lock()
+	hello := deviceStatsFor(id).hello
+	statsMu.Unlock()
+	if hello != nil && !slices.Contains(hello.Effects, t.Effect) {
+		writeError(w, fmt.Sprintf("device does not know effect %q", t.Effect), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseColor(t.Color); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validCycles(t.Cycles); err != nil {
+		writeError(w, "cycles: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validBrightness(t.Brightness); err != nil {
+		writeError(w, "brightness: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg := envelope("event", Broadcast{
+		Type: "test", Effect: t.Effect, Color: t.Color, Cycles: t.Cycles,
+		Brightness: t.Brightness, Palette: t.Palette, DeviceID: id,
+	})
+	n, _ := fanOut(connsFor(id), msg)
+	var devs []string
+	if n > 0 {
+		countEffect(id)
+		devs = []string{id}
+	}
+	recordHistory(HistoryEntry{Target: id, Devices: devs, Event: "test", Effect: t.Effect, Count: n})
+	writeJSON(w, map[string]any{"status": "sent", "connected": n > 0, "count": n})
+}
+
+// BulkPrefsReq writes one prefs document to every listed device, or to
+// every device in a group.
+type BulkPrefsReq struct {
+	DeviceIDs []string     `json:"deviceIds,omitempty"`
+	Group     string       `json:"group,omitempty"`
+	Prefs     *prefs.Prefs `json:"prefs"`
+}
+
+// BulkResult is one device's outcome of a bulk prefs write.
+type BulkResult struct {
+	DeviceID string `json:"deviceId"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Notified int    `json:"notified"` // sockets told to refetch
+}
+
+func handleBulkPrefs(w http.ResponseWriter, r *http.Request) {
+	var req BulkPrefsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Prefs == nil {
+		writeError(w, "need prefs", http.StatusBadRequest)
+		return
+	}
+	if (len(req.DeviceIDs) == 0) == (req.Group == "") {
+		writeError(w, "need exactly one of deviceIds or group", http.StatusBadRequest)
+		return
+	}
+	p := *req.Prefs
+	if p.Events == nil {
+		p.Events = map[string]prefs.Event{}
+	}
+	// validated once, before any device is touched
+	if err := validatePrefs(p); err != nil {
+		writePrefsError(w, err)
+		return
+	}
+
+	ids := req.DeviceIDs
+	if req.Group != "" {
+		ids = devicesInGroup(req.Group)
+		if len(ids) == 0 {
+			writeError(w, fmt.Sprintf("no devices in group %q", req.Group), http.StatusNotFound)
+			return
+		}
+	}
+
+	results := make([]BulkResult, 0, len(ids))
+	failed := 0
+	for _, id := range ids {
+		res := BulkResult{DeviceID: id}
+		if !deviceExists(id) {
+			res.Error = "unknown device"
+		} else {
+			prefsMu.Lock()
+			err := writeBulkPrefs(r, id, p)
+			prefsMu.Unlock()
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.OK = true
+				res.Notified, _ = fanOut(connsFor(id), envelope("config_updated", nil))
+			}
+		}
+		if !res.OK {
+			failed++
+		}
+		results = append(results, res)
+	}
+	log.Printf("bulk prefs: %d devices, %d failed", len(results), failed)
+	writeJSON(w, map[string]any{"results": results, "ok": len(results) - failed, "failed": failed})
+}
+
+// writeBulkPrefs writes p to one device of a bulk request (prefsMu held).
+// An If-Match applies to each device on its own: one whose stored prefs
+// don't match is skipped and reported, the rest are still written.
+func writeBulkPrefs(r *http.Request, id string, p prefs.Prefs) error {
+	if r.Header.Get("If-Match") != "" {
+		cur, err := readPrefs(id)
+		if err != nil {
+			return err
+		}
+		if !ifMatch(r, cur) {
+			return errPrefsChanged
+		}
+	}
+	return writePrefs(id, p)
+}
+
+// registeredDevices lists every device id, sorted.
+func registeredDevices() []string {
+	devMu.RLock()
+	defer devMu.RUnlock()
+	return slices.Sorted(maps.Keys(devices))
+}
+
+// devicesInGroup lists the ids in group (trimmed, any case), sorted.
+func devicesInGroup(group string) []string {
+	group = strings.TrimSpace(group)
+	devMu.RLock()
+	defer devMu.RUnlock()
+	var ids []string
+	for id, d := range devices {
+		if strings.EqualFold(d.Group, group) {
+			ids = append(ids, id)
 		}
 	}
+	sort.Strings(ids)
+	return ids
+}
+
+// handleDisconnect closes every socket of one device so a client stuck in
+// a bad state reconnects from scratch. The read loops end on their own and
+// their removeConn finds nothing left to remove.
+func handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !deviceExists(id) {
+		writeError(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	wsMu.Lock()
+	set := wsByDevice[id]
+	delete(wsByDevice, id)
 	wsMu.Unlock()
+	for c := range set {
+		c.closeWith(websocket.CloseNormalClosure, "disconnected by admin")
+	}
+	log.Printf("WS %s: admin closed %d connection(s)", id, len(set))
+	writeJSON(w, map[string]any{"status": "disconnected", "count": len(set)})
+}
+
+// A frame younger than frameFresh is served as is, so a dashboard polling
+// several tabs costs the device one reply a second; otherwise the device is
+// asked and given frameWait to answer.
+const (
+	frameFresh = time.Second
+	frameWait  = 3 * time.Second
+)
+
+// lastFrame is id's newest frame if it arrived after since.
+func lastFrame(id string, since time.Time) *FrameSnapshot {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if st := stats[id]; st != nil && st.frame != nil && st.frameAt.After(since) {
+		return st.frame
+	}
+	return nil
+}
+
+// handleDeviceFrame relays a get_frame to the device and returns its reply.
+func handleDeviceFrame(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !deviceExists(id) {
+		writeError(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	if f := lastFrame(id, time.Now().Add(-frameFresh)); f != nil {
+		writeJSON(w, f)
+		return
+	}
+	asked := time.Now()
+	if n, _ := fanOut(connsFor(id), envelope("get_frame", nil)); n == 0 {
+		writeError(w, "device not connected", http.StatusServiceUnavailable)
+		return
+	}
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	deadline := time.After(frameWait)
+	for {
+		select {
+		case <-t.C:
+			if f := lastFrame(id, asked); f != nil {
+				writeJSON(w, f)
+				return
+			}
+		case <-deadline:
+			writeError(w, "device did not send a frame", http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func handleNotifyConfig(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	n, _ := fanOut(connsFor(id), envelope("config_updated", nil))
 	writeJSON(w, map[string]any{"status": "notified", "count": n})
 }
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"celebration/prefs"
+
+	"github.com/gorilla/websocket"
+)
+
+const testAdminKey = "testkey"
+
+// testServer serves the API from a fresh data dir, with no devices and
+// admin key testAdminKey. The in-memory tables are emptied in place, under
+// their locks, since device sockets may still be winding down afterwards.
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	oldDir, oldDevFile, oldPrefsDir, oldHistory, oldKey := dataDir, devFile, prefsDir, historyFile, adminKey
+	dataDir = t.TempDir()
+	devFile = filepath.Join(dataDir, "devices.json")
+	prefsDir = filepath.Join(dataDir, "prefs")
+	historyFile = filepath.Join(dataDir, "history.jsonl")
+	adminKey = testAdminKey
+	reset := func() {
+		devMu.Lock()
+		clear(devices)
+		devMu.Unlock()
+		wsMu.Lock()
+		clear(wsByDevice)
+		wsMu.Unlock()
+		statsMu.Lock()
+		clear(stats)
+		statsMu.Unlock()
+	}
+	reset()
+
+	ts := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		reset()
+		dataDir, devFile, prefsDir, historyFile, adminKey = oldDir, oldDevFile, oldPrefsDir, oldHistory, oldKey
+	})
+	return ts
+}
+
+// addDevice registers id directly, with secret "s3cret-<id>".
+func addDevice(t *testing.T, id, group string) {
+	t.Helper()
+	devMu.Lock()
+	devices[id] = Device{ID: id, Secret: "s3cret-" + id, Label: strings.ToUpper(id), Group: group}
+	devMu.Unlock()
+}
+
+// dialDevice opens a signed device socket to ts as id and waits until the
+// server has registered it.
+func dialDevice(t *testing.T, ts *httptest.Server, id string) *websocket.Conn {
+	t.Helper()
+	before := len(connsFor(id))
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	hdr := http.Header{}
+	hdr.Set("X-Device-ID", id)
+	hdr.Set("X-Auth-Ts", stamp)
+	hdr.Set("X-Auth-Sig", makeSig(id, deviceSecret(id), stamp))
+	d := websocket.Dialer{Subprotocols: []string{wsSubprotocol}}
+	c, res, err := d.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", hdr)
+	if err != nil {
+		t.Fatalf("dial as %s: %v (%v)", id, err, res)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	waitFor(t, "socket registered", func() bool { return len(connsFor(id)) > before || len(connsFor(id)) == maxConnsPerDevice })
+	return c
+}
+
+// waitFor polls cond for up to two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// call sends an admin request and returns the response with its body read.
+// hdr is header name/value pairs.
+func call(t *testing.T, ts *httptest.Server, method, path, body string, hdr ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Admin-Key", testAdminKey)
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func storedPrefs(t *testing.T, id string) prefs.Prefs {
+	t.Helper()
+	p, err := readPrefs(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPatchPrefs(t *testing.T) {
+	base := prefs.Prefs{
+		Idle: prefs.Idle{Effect: "breath", Color: "#0000ff"},
+		Events: map[string]prefs.Event{
+			"deal_won":  {Effect: "blink", Color: "#00ff00", Cycles: 3},
+			"celebrate": {Effect: "wipe", Color: "#ff7f00", Cycles: 1},
+		},
+	}
+	cases := []struct {
+		name   string
+		patch  string
+		status int
+		check  func(t *testing.T, p prefs.Prefs)
+	}{
+		{"null deletes a key", `{"events":{"celebrate":null}}`, http.StatusOK, func(t *testing.T, p prefs.Prefs) {
+			if _, ok := p.Events["celebrate"]; ok {
+				t.Error("celebrate still there")
+			}
+			if _, ok := p.Events["deal_won"]; !ok {
+				t.Error("deal_won went with it")
+			}
+		}},
+		{"nested objects merge", `{"events":{"deal_won":{"color":"#ff0000"}}}`, http.StatusOK, func(t *testing.T, p prefs.Prefs) {
+			if ev := p.Events["deal_won"]; ev.Effect != "blink" || ev.Color != "#ff0000" || ev.Cycles != 3 {
+				t.Errorf("deal_won = %+v, want only its color changed", ev)
+			}
+			if p.Idle != base.Idle || len(p.Events) != 2 {
+				t.Errorf("untouched parts changed: %+v", p)
+			}
+		}},
+		{"nested add", `{"idle":{"effect":"warm","kelvin":2700},"events":{"ticket":{"effect":"wipe"}}}`, http.StatusOK, func(t *testing.T, p prefs.Prefs) {
+			if p.Idle.Effect != "warm" || p.Idle.Kelvin != 2700 || p.Idle.Color != "#0000ff" {
+				t.Errorf("idle = %+v, want warm 2700K keeping its color", p.Idle)
+			}
+			if len(p.Events) != 3 {
+				t.Errorf("events %v, want ticket added to the two", p.Events)
+			}
+		}},
+		{"merged result fails validation", `{"events":{"deal_won":{"cycles":99}}}`, http.StatusBadRequest, nil},
+		{"null on a required field", `{"events":{"deal_won":{"effect":null}}}`, http.StatusBadRequest, nil},
+		{"wrong type", `{"idle":{"kelvin":"warm"}}`, http.StatusBadRequest, nil},
+		{"not JSON", `{"idle":`, http.StatusBadRequest, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := testServer(t)
+			addDevice(t, "dev-a", "")
+			if err := writePrefs("dev-a", base); err != nil {
+				t.Fatal(err)
+			}
+
+			res, body := call(t, ts, http.MethodPatch, "/devices/dev-a/prefs", tc.patch)
+			if res.StatusCode != tc.status {
+				t.Fatalf("status %d, want %d: %s", res.StatusCode, tc.status, body)
+			}
+			p := storedPrefs(t, "dev-a")
+			if tc.check == nil {
+				if string(mustJSON(p)) != string(mustJSON(base)) {
+					t.Errorf("rejected patch changed the stored prefs: %+v", p)
+				}
+				return
+			}
+			tc.check(t, p)
+			var got prefs.Prefs
+			if err := json.Unmarshal([]byte(body), &got); err != nil || prefsETag(got) != prefsETag(p) {
+				t.Errorf("response %s is not the stored document", body)
+			}
+		})
+	}
+}
+
+func TestPrefsETag(t *testing.T) {
+	ts := testServer(t)
+	addDevice(t, "dev-a", "")
+
+	res, body := call(t, ts, http.MethodGet, "/devices/dev-a/prefs", "")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q: %s", res.StatusCode, etag, body)
+	}
+	if again, _ := call(t, ts, http.MethodGet, "/devices/dev-a/prefs", ""); again.Header.Get("ETag") != etag {
+		t.Errorf("ETag not stable across reads: %q then %q", etag, again.Header.Get("ETag"))
+	}
+
+	put := `{"idle":{"effect":"breath","color":"#ff0000"},"events":{}}`
+	cases := []struct {
+		name    string
+		method  string
+		ifMatch func(cur string) string
+		status  int
+	}{
+		{"PUT, stale", http.MethodPut, func(string) string { return `"0000000000000000"` }, http.StatusPreconditionFailed},
+		{"PATCH, stale", http.MethodPatch, func(string) string { return `"0000000000000000"` }, http.StatusPreconditionFailed},
+		{"PUT, current", http.MethodPut, func(cur string) string { return cur }, http.StatusOK},
+		{"PATCH, weak current", http.MethodPatch, func(cur string) string { return "W/" + cur }, http.StatusOK},
+		{"PUT, current in a list", http.MethodPut, func(cur string) string { return `"0000000000000000", ` + cur }, http.StatusOK},
+		{"PATCH, any", http.MethodPatch, func(string) string { return "*" }, http.StatusOK},
+		{"PUT, none", http.MethodPut, func(string) string { return "" }, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := storedPrefs(t, "dev-a")
+			cur := prefsETag(before)
+			res, body := call(t, ts, tc.method, "/devices/dev-a/prefs", put, "If-Match", tc.ifMatch(cur))
+			if res.StatusCode != tc.status {
+				t.Fatalf("status %d, want %d: %s", res.StatusCode, tc.status, body)
+			}
+			after := storedPrefs(t, "dev-a")
+			if tc.status == http.StatusPreconditionFailed {
+				if res.Header.Get("ETag") != cur || prefsETag(after) != cur {
+					t.Errorf("412 with ETag %q and stored %q, want both %q", res.Header.Get("ETag"), prefsETag(after), cur)
+				}
+				return
+			}
+			if after.Idle.Color != "#ff0000" {
+				t.Errorf("stored idle %+v, want the write applied", after.Idle)
+			}
+			if got, _ := call(t, ts, http.MethodGet, "/devices/dev-a/prefs", ""); res.Header.Get("ETag") != got.Header.Get("ETag") {
+				t.Errorf("write returned ETag %q, GET says %q", res.Header.Get("ETag"), got.Header.Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestBulkPrefsIfMatch(t *testing.T) {
+	ts := testServer(t)
+	addDevice(t, "dev-a", "floor")
+	addDevice(t, "dev-b", "floor")
+	if err := writePrefs("dev-b", prefs.Prefs{Idle: prefs.Idle{Effect: "off"}, Events: map[string]prefs.Event{}}); err != nil {
+		t.Fatal(err)
+	}
+	read := prefsETag(storedPrefs(t, "dev-a")) // what a client read from dev-a
+	theme := `{"group":"floor","prefs":{"idle":{"effect":"warm","kelvin":2700}}}`
+
+	res, body := call(t, ts, http.MethodPost, "/prefs/bulk", theme, "If-Match", read)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", res.StatusCode, body)
+	}
+	var out struct {
+		Results []BulkResult `json:"results"`
+		OK      int          `json:"ok"`
+		Failed  int          `json:"failed"`
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.OK != 1 || out.Failed != 1 || len(out.Results) != 2 {
+		t.Fatalf("got %+v, want dev-a written and dev-b refused", out)
+	}
+	if r := out.Results[1]; r.DeviceID != "dev-b" || r.OK || r.Error != errPrefsChanged.Error() {
+		t.Errorf("dev-b result %+v, want refused as changed", r)
+	}
+	if storedPrefs(t, "dev-a").Idle.Effect != "warm" || storedPrefs(t, "dev-b").Idle.Effect != "off" {
+		t.Error("If-Match not applied per device")
+	}
+
+	// without If-Match every device is written
+	if res, body := call(t, ts, http.MethodPost, "/prefs/bulk", theme); res.StatusCode != http.StatusOK || !strings.Contains(body, `"failed":0`) {
+		t.Fatalf("status %d: %s", res.StatusCode, body)
+	}
+	if storedPrefs(t, "dev-b").Idle.Effect != "warm" {
+		t.Error("unconditional bulk write skipped dev-b")
+	}
+}
+
+func TestConnCapClosesOldest(t *testing.T) {
+	ts := testServer(t)
+	addDevice(t, "dev-a", "")
+	old := maxConnsPerDevice
+	maxConnsPerDevice = 2
+	t.Cleanup(func() { maxConnsPerDevice = old })
+
+	var socks []*websocket.Conn
+	for range maxConnsPerDevice + 1 {
+		socks = append(socks, dialDevice(t, ts, "dev-a"))
+		time.Sleep(2 * time.Millisecond) // distinct open times
+	}
+
+	// the first socket is closed by the server...
+	_ = socks[0].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := socks[0].ReadMessage(); err == nil {
+		t.Fatal("first socket got a message, want it closed")
+	} else if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+		t.Fatal("first socket still open past the cap")
+	}
+	waitFor(t, "the cap", func() bool { return len(connsFor("dev-a")) == maxConnsPerDevice })
+
+	// ...and the newer ones still get broadcasts
+	res, body := call(t, ts, http.MethodPost, "/test/broadcast", `{"deviceId":"dev-a","type":"deal_won"}`)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"count":2`) {
+		t.Fatalf("broadcast: status %d: %s", res.StatusCode, body)
+	}
+	for i, c := range socks[1:] {
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, msg, err := c.ReadMessage(); err != nil || !strings.Contains(string(msg), "deal_won") {
+			t.Errorf("socket %d: %q, %v; want the broadcast", i+2, msg, err)
+		}
+	}
+}
+
+func TestHandleClientMessage(t *testing.T) {
+	hello := `{"version":"1.4.0","effects":["blink","wipe"],"ledCount":30}`
+	cases := []struct {
+		name      string
+		msg       string
+		wantErr   bool
+		wantHello string // version recorded, "" = none
+		wantFrame int    // ledCount recorded, 0 = none
+	}{
+		{"hello", `{"v":1,"type":"hello","payload":` + hello + `}`, false, "1.4.0", 0},
+		{"legacy hello (v0, fields at the top)", `{"type":"hello","version":"1.2.0","effects":["blink"],"ledCount":8}`, false, "1.2.0", 0},
+		{"v1 hello without payload", `{"v":1,"type":"hello"}`, true, "", 0},
+		{"hello with a bad payload", `{"v":1,"type":"hello","payload":{"ledCount":"thirty"}}`, true, "", 0},
+		{"ack", `{"v":1,"type":"ack","payload":{"id":"x"}}`, false, "", 0},
+		{"legacy ack", `{"type":"ack"}`, false, "", 0},
+		{"pong", `{"v":1,"type":"pong"}`, false, "", 0},
+		{"frame snapshot", `{"v":1,"type":"frame_snapshot","payload":{"leds":"ff000000ff00","ledCount":2,"at":1}}`, false, "", 2},
+		{"frame snapshot, short", `{"v":1,"type":"frame_snapshot","payload":{"leds":"ff0000","ledCount":2}}`, true, "", 0},
+		{"frame snapshot, not hex", `{"v":1,"type":"frame_snapshot","payload":{"leds":"zz0000","ledCount":1}}`, true, "", 0},
+		{"status (unknown, ignored)", `{"v":1,"type":"status","payload":{"temp":41}}`, false, "", 0},
+		{"unknown legacy type", `{"type":"whatever"}`, false, "", 0},
+		{"no type", `{"v":1}`, false, "", 0},
+		{"not JSON", `hello`, true, "", 0},
+		{"JSON array", `["hello"]`, true, "", 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testServer(t)
+
+			err := handleClientMessage("dev-a", wsSubprotocol, []byte(tc.msg))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tc.wantErr)
+			}
+			statsMu.Lock()
+			st := deviceStatsFor("dev-a")
+			h, f := st.hello, st.frame
+			statsMu.Unlock()
+			switch {
+			case tc.wantHello == "" && h != nil:
+				t.Errorf("hello recorded: %+v", h)
+			case tc.wantHello != "" && (h == nil || h.Version != tc.wantHello || h.Protocol != wsSubprotocol || h.Type != ""):
+				t.Errorf("hello %+v, want version %s on %s", h, tc.wantHello, wsSubprotocol)
+			}
+			switch {
+			case tc.wantFrame == 0 && f != nil:
+				t.Errorf("frame recorded: %+v", f)
+			case tc.wantFrame != 0 && (f == nil || f.LedCount != tc.wantFrame):
+				t.Errorf("frame %+v, want %d LEDs", f, tc.wantFrame)
+			}
+		})
+	}
+}
+
+func TestMalformedClientMessageDropsSocket(t *testing.T) {
+	ts := testServer(t)
+	addDevice(t, "dev-a", "")
+	c := dialDevice(t, ts, "dev-a")
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"type":"hello","payload":`+`{"version":"1.4.0"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the hello", func() bool {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		return deviceStatsFor("dev-a").hello != nil
+	})
+	if err := c.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData) {
+		t.Errorf("read after a malformed message: %v, want close 1007", err)
+	}
+}
+
+func TestBroadcastFanOut(t *testing.T) {
+	// dev-a has two sockets, dev-b one, dev-c is registered but offline
+	cases := []struct {
+		name       string
+		fake       bool
+		body       string
+		wantCount  int
+		wantLabels []string
+		wantSocks  int // of the three real sockets
+	}{
+		{"all", false, `{"type":"deal_won"}`, 3, []string{"DEV-A", "DEV-B"}, 3},
+		{"one device, every socket", false, `{"type":"deal_won","deviceId":"dev-a"}`, 2, []string{"DEV-A"}, 2},
+		{"excluded", false, `{"type":"deal_won","excludeDeviceIds":["dev-a"]}`, 1, []string{"DEV-B"}, 1},
+		{"offline device", false, `{"type":"deal_won","deviceId":"dev-c"}`, 0, []string{}, 0},
+		{"fake: all counts offline devices too", true, `{"type":"deal_won"}`, 4, []string{"DEV-A", "DEV-B", "DEV-C"}, 3},
+		{"fake: excluded offline device", true, `{"type":"deal_won","excludeDeviceIds":["dev-c"]}`, 3, []string{"DEV-A", "DEV-B"}, 3},
+		{"fake: offline device", true, `{"type":"deal_won","deviceId":"dev-c"}`, 1, []string{"DEV-C"}, 0},
+		{"fake: unregistered device", true, `{"type":"deal_won","deviceId":"dev-x"}`, 1, []string{"dev-x"}, 0},
+		{"fake: online device is not counted twice", true, `{"type":"deal_won","deviceId":"dev-a"}`, 2, []string{"DEV-A"}, 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := testServer(t)
+			old := fakeDevices
+			fakeDevices = tc.fake
+			t.Cleanup(func() { fakeDevices = old })
+			for _, id := range []string{"dev-a", "dev-b", "dev-c"} {
+				addDevice(t, id, "")
+			}
+			socks := []*websocket.Conn{dialDevice(t, ts, "dev-a"), dialDevice(t, ts, "dev-a"), dialDevice(t, ts, "dev-b")}
+
+			res, body := call(t, ts, http.MethodPost, "/test/broadcast", tc.body)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status %d: %s", res.StatusCode, body)
+			}
+			var out struct {
+				Count  int      `json:"count"`
+				Labels []string `json:"labels"`
+				Fake   bool     `json:"fake"`
+			}
+			if err := json.Unmarshal([]byte(body), &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Count != tc.wantCount || strings.Join(out.Labels, ",") != strings.Join(tc.wantLabels, ",") || out.Fake != tc.fake {
+				t.Errorf("got %s, want count %d labels %v fake %v", body, tc.wantCount, tc.wantLabels, tc.fake)
+			}
+
+			// a fake send never reaches a real socket
+			got := 0
+			for _, c := range socks {
+				_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if _, _, err := c.ReadMessage(); err == nil {
+					got++
+				}
+			}
+			if got != tc.wantSocks {
+				t.Errorf("%d sockets got the broadcast, want %d", got, tc.wantSocks)
+			}
+		})
+	}
+}
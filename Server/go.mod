@@ -5,3 +5,7 @@ go 1.24.0
 require github.com/gorilla/websocket v1.5.3
 
 require github.com/go-chi/chi/v5 v5.2.2
+
+require celebration v0.0.0-00010101000000-000000000000
+
+replace celebration => ../Client
@@ -4,16 +4,44 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
-	"celebration/Client/ledcontrol"
+	"celebration/ledcontrol"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// Browser origins allowed to open the websocket (WS_ORIGINS, comma-separated,
+// "*" for any), read once at startup. Same format as the API server's.
+var wsOrigins = parseOrigins(os.Getenv("WS_ORIGINS"))
+
+func parseOrigins(v string) map[string]bool {
+	m := map[string]bool{}
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			m[o] = true
+		}
+	}
+	return m
+}
+
+// checkOrigin mirrors the API server's checkWSOrigin: clients without an
+// Origin (scripts, devices), the web UI served from here, and WS_ORIGINS
+// entries get in. Other browser pages are refused.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || wsOrigins["*"] || wsOrigins[strings.TrimRight(origin, "/")] {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
 		return true
-	},
+	}
+	log.Printf("WebSocket: refusing origin %q (not in WS_ORIGINS)", origin)
+	return false
 }
 
 var clients = make(map[*websocket.Conn]bool)